@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/eric-carlsson/compact-git-status/gitstatus"
+)
+
+// Config is a parsed configuration file, mapping table names to the options
+// in them. Options outside of any table are in the "" table.
+type Config map[string]map[string]string
+
+// configPath returns the path of the configuration file.
+func configPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("get home dir: %w", err)
+		}
+		dir = filepath.Join(home, ".config")
+	}
+
+	return filepath.Join(dir, "compact-git-status", "config.toml"), nil
+}
+
+// configOptions are options along with where they were set from.
+type configOptions struct {
+	options map[string]string
+	source  string
+}
+
+// readConfigFile reads the options of the configuration file at path, or the
+// default configuration file if path is empty, in order of precedence.
+// Options in the [profile.<name>] table of the profile take precedence over
+// the rest of the file. If profile is empty, the profile option of the file is
+// used.
+func readConfigFile(path, profile string) ([]configOptions, error) {
+	explicit := path != ""
+	if !explicit {
+		var err error
+		if path, err = configPath(); err != nil {
+			return nil, err
+		}
+	}
+
+	config, err := readConfig(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var options []configOptions
+	if profile == "" {
+		profile = config[""]["profile"]
+	}
+	if profile != "" {
+		profileOptions, ok := config["profile."+profile]
+		if !ok {
+			return nil, fmt.Errorf("config %s: unknown profile %q", path, profile)
+		}
+		options = append(options, configOptions{profileOptions, fmt.Sprintf("%s [profile.%s]", path, profile)})
+	}
+
+	return append(options, configOptions{config[""], path}), nil
+}
+
+// loadOptions sets the flags not already set from the per-repository
+// configuration, then the git config and lastly the configuration file at
+// configPath, and returns the repository containing path.
+func loadOptions(path, configPath, profile string) (gitstatus.Repo, error) {
+	config, err := readConfigFile(configPath, profile)
+	if err != nil {
+		return gitstatus.Repo{}, err
+	}
+
+	// The repository is looked up once for the per-repository
+	// configuration, the git config and the status
+	repo, err := gitstatus.LookupRepo(path, gitConfigSection)
+	if err != nil {
+		return gitstatus.Repo{}, err
+	}
+
+	if err := loadRepoConfig(repo); err != nil {
+		return gitstatus.Repo{}, err
+	}
+	if err := loadGitConfig(repo); err != nil {
+		return gitstatus.Repo{}, err
+	}
+	if err := loadConfig(config); err != nil {
+		return gitstatus.Repo{}, err
+	}
+
+	return repo, nil
+}
+
+// loadConfig sets the flags not already set from the options read from a
+// configuration file.
+func loadConfig(options []configOptions) error {
+	for _, o := range options {
+		if err := applyOptions(o.options, o.source); err != nil {
+			return fmt.Errorf("config %s: %w", o.source, err)
+		}
+	}
+
+	return nil
+}
+
+// loadEnv sets the flags not already set from CGS_* environment variables,
+// e.g. CGS_SYMBOL_MODIFIED for -symbol-modified.
+func loadEnv() error {
+	options := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			options[f.Name] = value
+		}
+	})
+
+	if err := applyOptions(options, "environment"); err != nil {
+		return fmt.Errorf("environment: %w", err)
+	}
+
+	return nil
+}
+
+// envName returns the environment variable for the named flag.
+func envName(name string) string {
+	return "CGS_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// repoConfigName is the name of the per-repository configuration file, which
+// is read from the top level of the working tree.
+const repoConfigName = ".compact-git-status"
+
+// repoOptions are the options a per-repository configuration file can set,
+// besides the symbol-* and color-* options. The file comes with the
+// repository and can't be trusted, so it is limited to how the status is
+// displayed and can't name paths, revisions, file descriptors or output
+// formats.
+var repoOptions = map[string]bool{
+	"ab-fraction":         true,
+	"bare-label":          true,
+	"behind-first":        true,
+	"branch-stashes":      true,
+	"check-even":          true,
+	"churn":               true,
+	"compact-state":       true,
+	"describe":            true,
+	"digit-sep":           true,
+	"dirty-marker":        true,
+	"empty-brackets":      true,
+	"even":                true,
+	"fixed-width":         true,
+	"group-digits":        true,
+	"hash-length":         true,
+	"hide-clean":          true,
+	"hide-op-detached":    true,
+	"icons-only":          true,
+	"local-position":      true,
+	"local-sep":           true,
+	"max-count":           true,
+	"no-branch":           true,
+	"no-stash":            true,
+	"no-state":            true,
+	"no-untracked":        true,
+	"no-upstream":         true,
+	"patch-length":        true,
+	"protected":           true,
+	"protected-branches":  true,
+	"pull-hint":           true,
+	"push-hint":           true,
+	"show-age":            true,
+	"show-autostash":      true,
+	"show-base":           true,
+	"show-hash":           true,
+	"show-hints":          true,
+	"show-ignored":        true,
+	"show-push":           true,
+	"show-signature":      true,
+	"show-sparse-index":   true,
+	"show-stash-conflict": true,
+	"show-stash-message":  true,
+	"show-subject":        true,
+	"show-tag":            true,
+	"show-todo":           true,
+	"show-upstream":       true,
+	"split-modified":      true,
+	"stale-after":         true,
+	"stash-ignores-clean": true,
+	"state-labels":        true,
+	"state-position":      true,
+	"state-sep":           true,
+	"symbols":             true,
+	"sync-hint":           true,
+	"theme":               true,
+	"untracked-is-clean":  true,
+	"worktree-locked":     true,
+}
+
+// loadRepoConfig sets the flags not already set from the per-repository
+// configuration file of the working tree of repo, if any. Options the file
+// can't set are ignored with a warning.
+func loadRepoConfig(repo gitstatus.Repo) error {
+	if repo.TopLevel == "" {
+		// There is nothing to read outside a working tree
+		return nil
+	}
+
+	file := filepath.Join(repo.TopLevel, repoConfigName)
+	config, err := readConfig(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	options, ignored := repoConfigOptions(config[""])
+	if len(ignored) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: ignoring options a repository can't set: %s\n", file, strings.Join(ignored, ", "))
+	}
+
+	if err := applyOptions(options, file); err != nil {
+		return fmt.Errorf("config %s: %w", file, err)
+	}
+
+	return nil
+}
+
+// repoConfigOptions splits the options of a per-repository configuration
+// file into those it can set and the names of those it can't. Besides colors,
+// which are validated, values can't contain characters a shell or tmux would
+// interpret when they are printed.
+func repoConfigOptions(options map[string]string) (map[string]string, []string) {
+	allowed := make(map[string]string)
+	var ignored []string
+	for _, name := range sortedKeys(options) {
+		value := options[name]
+		switch {
+		case strings.HasPrefix(name, "color-"):
+			// Colors are validated when they are set
+		case !repoOptions[name] && !strings.HasPrefix(name, "symbol-"), strings.ContainsFunc(value, unsafeRepoRune):
+			ignored = append(ignored, name)
+			continue
+		}
+		allowed[name] = value
+	}
+
+	return allowed, ignored
+}
+
+// unsafeRepoRune reports whether r is a control character, or is interpreted
+// by a shell prompt or tmux.
+func unsafeRepoRune(r rune) bool {
+	return unicode.IsControl(r) || strings.ContainsRune("$`\\%#", r)
+}
+
+// gitConfigSection is the git config section read along with the repository,
+// e.g. compactstatus.symbol-modified for -symbol-modified.
+const gitConfigSection = "compactstatus"
+
+// loadGitConfig sets the flags not already set from the compactstatus.* git
+// config read along with repo.
+func loadGitConfig(repo gitstatus.Repo) error {
+	if err := applyOptions(repo.Config, "git config"); err != nil {
+		return fmt.Errorf("git config: %w", err)
+	}
+
+	return nil
+}
+
+// readConfig reads and parses the configuration file at path.
+func readConfig(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open config: %w", err)
+	}
+	defer f.Close()
+
+	config, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// optionSources maps the names of the flags that have been set to where they
+// were set from.
+var optionSources = make(map[string]string)
+
+// applyOptions sets the flags named by the options, except those that have
+// already been set, recording source as where they were set from.
+func applyOptions(options map[string]string, source string) error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for _, name := range sortedKeys(options) {
+		if set[name] {
+			continue
+		}
+
+		if err := flag.Set(name, options[name]); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		optionSources[name] = source
+	}
+
+	return nil
+}
+
+// sortedKeys returns the sorted keys of m.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+// runConfig runs the config subcommand:
+//
+//	config show               print the effective options and their sources
+//	config get <name>         print the effective value of an option
+//	config set <name> <value> set an option in the configuration file
+//	config validate [<file>]  check a configuration file
+//
+// The options are only loaded, with load, to show or get them.
+func runConfig(args []string, out io.Writer, path string, load func() error) error {
+	if path == "" {
+		var err error
+		if path, err = configPath(); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case len(args) == 1 && args[0] == "show":
+		if err := load(); err != nil {
+			return err
+		}
+		flag.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(out, "%s = %s", f.Name, formatConfigValue(f.Value.String()))
+			if source, ok := optionSources[f.Name]; ok {
+				fmt.Fprintf(out, " # %s", source)
+			}
+			fmt.Fprintln(out)
+		})
+		return nil
+
+	case len(args) == 2 && args[0] == "get":
+		f := flag.Lookup(args[1])
+		if f == nil {
+			return fmt.Errorf("unknown option %q", args[1])
+		}
+		if err := load(); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, f.Value.String())
+		return nil
+
+	case len(args) == 3 && args[0] == "set":
+		// Setting the flag validates the value
+		if err := flag.Set(args[1], args[2]); err != nil {
+			return fmt.Errorf("%s: %w", args[1], err)
+		}
+		return setConfigOption(path, args[1], args[2])
+
+	case len(args) >= 1 && len(args) <= 2 && args[0] == "validate":
+		if len(args) == 2 {
+			path = args[1]
+		}
+
+		config, err := readConfig(path)
+		if err != nil {
+			return err
+		}
+		for table, options := range config {
+			if table != "" && !strings.HasPrefix(table, "profile.") {
+				return fmt.Errorf("config %s: unknown table %q", path, table)
+			}
+
+			for _, name := range sortedKeys(options) {
+				if err := flag.Set(name, options[name]); err != nil {
+					return fmt.Errorf("config %s: %s: %w", path, name, err)
+				}
+			}
+		}
+		fmt.Fprintf(out, "%s is valid\n", path)
+		return nil
+
+	default:
+		return errors.New("usage: config show | get <name> | set <name> <value> | validate [<file>]")
+	}
+}
+
+// setConfigOption sets the option in the configuration file at path, keeping
+// the rest of the file intact.
+func setConfigOption(path, name, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read config: %w", err)
+	}
+
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	option := fmt.Sprintf("%s = %s", name, formatConfigValue(value))
+
+	// Options are set in the root table, which ends at the first table
+	end := len(lines)
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			end = i
+			break
+		}
+
+		if key, _, ok := strings.Cut(line, "="); ok && !isComment(line) && strings.Trim(strings.TrimSpace(key), `"`) == name {
+			lines[i] = option
+			end = -1
+			break
+		}
+	}
+	if end >= 0 {
+		for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+			end--
+		}
+		lines = slices.Insert(lines, end, option)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create config dir: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+
+	return nil
+}
+
+// formatConfigValue formats a flag value as a configuration file value,
+// leaving booleans and numbers unquoted.
+func formatConfigValue(value string) string {
+	if parsed, rest, err := parseConfigValue(value); err == nil && rest == "" && parsed == value {
+		return value
+	}
+
+	return strconv.Quote(value)
+}
+
+// parseConfig parses a configuration file in the subset of TOML made up of
+// tables and key/value pairs, with string, boolean, number and array values.
+// Values are returned as flag values, with arrays joined by commas.
+func parseConfig(r io.Reader) (Config, error) {
+	config := Config{"": {}}
+	table := ""
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if isComment(line) {
+			continue
+		}
+
+		if name, ok := strings.CutPrefix(line, "["); ok {
+			name, rest, ok := strings.Cut(name, "]")
+			if !ok || !isComment(rest) {
+				return nil, fmt.Errorf("line %d: invalid table %q", n, line)
+			}
+
+			table = strings.TrimSpace(name)
+			if config[table] == nil {
+				config[table] = make(map[string]string)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+
+		value, rest, err := parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, key, err)
+		}
+		if !isComment(rest) {
+			return nil, fmt.Errorf("line %d: %s: unexpected %q after value", n, key, rest)
+		}
+
+		if _, ok := config[table][key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %s", n, key)
+		}
+		config[table][key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	return config, nil
+}
+
+// parseConfigValue parses the value at the start of s and returns it along
+// with the rest of s.
+func parseConfigValue(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				value, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", fmt.Errorf("invalid string %s", s[:i+1])
+				}
+				return value, strings.TrimSpace(s[i+1:]), nil
+			}
+		}
+		return "", "", errors.New("unterminated string")
+
+	case strings.HasPrefix(s, "'"):
+		value, rest, ok := strings.Cut(s[1:], "'")
+		if !ok {
+			return "", "", errors.New("unterminated string")
+		}
+		return value, strings.TrimSpace(rest), nil
+
+	case strings.HasPrefix(s, "["):
+		var values []string
+
+		s = strings.TrimSpace(s[1:])
+		for !strings.HasPrefix(s, "]") {
+			value, rest, err := parseConfigValue(s)
+			if err != nil {
+				return "", "", err
+			}
+			values = append(values, value)
+
+			rest, ok := strings.CutPrefix(rest, ",")
+			if !ok && !strings.HasPrefix(rest, "]") {
+				return "", "", errors.New("unterminated array")
+			}
+			s = strings.TrimSpace(rest)
+		}
+
+		return strings.Join(values, ","), strings.TrimSpace(s[1:]), nil
+
+	default:
+		end := strings.IndexAny(s, " \t#,]")
+		if end < 0 {
+			end = len(s)
+		}
+
+		value := s[:end]
+		if _, err := strconv.ParseFloat(strings.ReplaceAll(value, "_", ""), 64); err != nil && value != "true" && value != "false" {
+			return "", "", fmt.Errorf("invalid value %q", value)
+		}
+		return strings.ReplaceAll(value, "_", ""), strings.TrimSpace(s[end:]), nil
+	}
+}
+
+// isComment reports whether s is empty or a comment.
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRepoConfigOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		allowed bool
+	}{
+		{"symbol-modified", "+", true},
+		{"symbol-modified", "$(touch pwned)", false},
+		{"symbol-clean", "`touch pwned`", false},
+		{"symbol-clean", "\x1b]52;c;cHduZWQ=\a", false},
+		{"color-modified", "#ff8700", true},
+		{"show-tag", "true", true},
+		{"state-labels", "MERGING=MG", true},
+		{"bare-label", "%F{red}", false},
+		{"against", "--output=pwned", false},
+		{"base", "main", false},
+		{"symbols-file", "/etc/passwd", false},
+		{"config", "pwned.toml", false},
+		{"path", "/", false},
+		{"fd", "3", false},
+		{"format", "{{.Status}}", false},
+		{"shell", "", false},
+		{"output", "tmux", false},
+		{"backend", "native", false},
+		{"unknown", "true", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			allowed, ignored := repoConfigOptions(map[string]string{tt.name: tt.value})
+
+			wantAllowed, wantIgnored := map[string]string{tt.name: tt.value}, []string(nil)
+			if !tt.allowed {
+				wantAllowed, wantIgnored = map[string]string{}, []string{tt.name}
+			}
+			if !reflect.DeepEqual(allowed, wantAllowed) || !reflect.DeepEqual(ignored, wantIgnored) {
+				t.Errorf("repoConfigOptions() = %v, %v, want %v, %v", allowed, ignored, wantAllowed, wantIgnored)
+			}
+		})
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    Config
+		wantErr string
+	}{
+		{"empty", "", Config{"": {}}, ""},
+		{"comments", "# comment\n\nshow-tag = true # trailing\n", Config{"": {"show-tag": "true"}}, ""},
+		{"basic string", `symbol-modified = "M "`, Config{"": {"symbol-modified": "M "}}, ""},
+		{"escapes", `symbol-modified = "\t\"\u00b1\\"`, Config{"": {"symbol-modified": "\t\"±\\"}}, ""},
+		{"hash in string", `symbol-stashed = "#" # comment`, Config{"": {"symbol-stashed": "#"}}, ""},
+		{"literal string", `symbols-file = 'C:\symbols.toml'`, Config{"": {"symbols-file": `C:\symbols.toml`}}, ""},
+		{"quoted key", `"max-count" = 99`, Config{"": {"max-count": "99"}}, ""},
+		{"number", "max-count = 1_000", Config{"": {"max-count": "1000"}}, ""},
+		{"array", `protected-branches = ["main", 'release', 1]`, Config{"": {"protected-branches": "main,release,1"}}, ""},
+		{"empty array", "protected-branches = []", Config{"": {"protected-branches": ""}}, ""},
+		{"tables", "theme = \"nerd\"\n[profile.work]\ntheme = \"minimal\"\n[ profile.home ] # comment\n", Config{"": {"theme": "nerd"}, "profile.work": {"theme": "minimal"}, "profile.home": {}}, ""},
+		{"unterminated string", `theme = "nerd`, nil, "line 1: theme: unterminated string"},
+		{"unterminated literal string", `theme = 'nerd`, nil, "line 1: theme: unterminated string"},
+		{"unterminated array", `protected-branches = ["main" "release"]`, nil, "line 1: protected-branches: unterminated array"},
+		{"invalid table", "[profile.work", nil, "line 1: invalid table"},
+		{"missing value", "show-tag\n", nil, "line 1: expected key = value"},
+		{"bare word", "theme = nerd", nil, `line 1: theme: invalid value "nerd"`},
+		{"trailing value", "max-count = 1 2", nil, `line 1: max-count: unexpected "2" after value`},
+		{"duplicate key", "show-tag = true\nshow-tag = false", nil, "line 2: duplicate key show-tag"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfig(strings.NewReader(tt.config))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatConfigValue(t *testing.T) {
+	for value, want := range map[string]string{
+		"true":  "true",
+		"99":    "99",
+		"1.5":   "1.5",
+		"1_000": `"1_000"`,
+		"M ":    `"M "`,
+		"nerd":  `"nerd"`,
+		`a"b\c`: `"a\"b\\c"`,
+		"":      `""`,
+	} {
+		if got := formatConfigValue(value); got != want {
+			t.Errorf("formatConfigValue(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestSetConfigOption(t *testing.T) {
+	tests := []struct {
+		name, config, option, value, want string
+	}{
+		{"new file", "", "max-count", "99", "max-count = 99\n"},
+		{"append", "show-tag = true\n", "theme", "nerd", "show-tag = true\ntheme = \"nerd\"\n"},
+		{"replace", "max-count = 9 # small\nshow-tag = true\n", "max-count", "99", "max-count = 99\nshow-tag = true\n"},
+		{"replace quoted key", "\"max-count\" = 9\n", "max-count", "99", "max-count = 99\n"},
+		{"commented out", "# max-count = 9\n", "max-count", "99", "# max-count = 9\nmax-count = 99\n"},
+		{"before tables", "show-tag = true\n\n[profile.work]\nmax-count = 9\n", "max-count", "99", "show-tag = true\nmax-count = 99\n\n[profile.work]\nmax-count = 9\n"},
+		{"only tables", "[profile.work]\nmax-count = 9\n", "max-count", "99", "max-count = 99\n[profile.work]\nmax-count = 9\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "compact-git-status", "config.toml")
+			if tt.config != "" {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := setConfigOption(path, tt.option, tt.value); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("setConfigOption() wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
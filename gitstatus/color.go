@@ -0,0 +1,241 @@
+package gitstatus
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Colors represents the colors of each segment, using git's color syntax
+// (e.g. "yellow", "bold red", "208" or "#ff8700").
+type Colors struct {
+	Branch    string
+	State     string
+	Ahead     string
+	Behind    string
+	Staged    string
+	Conflict  string
+	Modified  string
+	Untracked string
+	Stashed   string
+	Clean     string
+	Age       string
+	Stale     string
+}
+
+// Color modes.
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// Output formats for colors.
+const (
+	OutputANSI = "ansi"
+	OutputTmux = "tmux"
+)
+
+// colorReset resets all ANSI colors and attributes.
+const colorReset = "\x1b[0m"
+
+// colorNames are the basic color names, in ANSI order.
+var colorNames = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// colorAttributes maps attribute names to their ANSI parameters. Like in git,
+// attributes other than reset can be turned off with a "no" or "no-" prefix.
+var colorAttributes = map[string]int{
+	"reset":   0,
+	"bold":    1,
+	"dim":     2,
+	"italic":  3,
+	"ul":      4,
+	"blink":   5,
+	"reverse": 7,
+	"strike":  9,
+}
+
+// tmuxAttributes maps attribute names to their tmux style names, which are
+// turned off with a "no" prefix.
+var tmuxAttributes = map[string]string{
+	"reset":   "fg=default,bg=default,none",
+	"bold":    "bold",
+	"dim":     "dim",
+	"italic":  "italics",
+	"ul":      "underscore",
+	"blink":   "blink",
+	"reverse": "reverse",
+	"strike":  "strikethrough",
+}
+
+// colorAttribute returns the name and ANSI parameter of an attribute word, and
+// whether it turns the attribute off.
+func colorAttribute(word string) (name string, param int, off bool, ok bool) {
+	if param, ok := colorAttributes[word]; ok {
+		return word, param, false, true
+	}
+
+	name, ok = strings.CutPrefix(word, "no")
+	if !ok {
+		return "", 0, false, false
+	}
+	name = strings.TrimPrefix(name, "-")
+	if param, ok = colorAttributes[name]; !ok || name == "reset" {
+		return "", 0, false, false
+	}
+
+	// Bold and dim are both turned off by 22, the rest by their parameter
+	// plus 20
+	return name, max(param, 2) + 20, true, true
+}
+
+// validateColors checks that every color can be parsed.
+func validateColors(colors Colors) error {
+	v := reflect.ValueOf(colors)
+	for i := range v.NumField() {
+		if _, err := ANSIColor(v.Field(i).String()); err != nil {
+			return fmt.Errorf("%s color: %w", v.Type().Field(i).Name, err)
+		}
+	}
+
+	return nil
+}
+
+// ANSIColor converts a color to an ANSI escape sequence.
+func ANSIColor(color string) (string, error) {
+	var params []string
+
+	colors := 0
+	for _, word := range strings.Fields(color) {
+		if _, param, _, ok := colorAttribute(word); ok {
+			params = append(params, strconv.Itoa(param))
+			continue
+		}
+
+		// The first color is the foreground, the second the background
+		if colors++; colors > 2 {
+			return "", fmt.Errorf("too many colors in %q", color)
+		}
+
+		param, err := ansiColorParam(word, colors == 2)
+		if err != nil {
+			return "", err
+		}
+
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+
+	if len(params) == 0 {
+		return "", nil
+	}
+
+	return fmt.Sprintf("\x1b[%sm", strings.Join(params, ";")), nil
+}
+
+// ansiColorParam converts a single color word to an ANSI parameter.
+func ansiColorParam(word string, background bool) (string, error) {
+	base, extended := 30, 38
+	if background {
+		base, extended = 40, 48
+	}
+
+	if word == "normal" {
+		return "", nil
+	}
+	if word == "default" {
+		return strconv.Itoa(base + 9), nil
+	}
+
+	if hex, ok := strings.CutPrefix(word, "#"); ok {
+		rgb, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 6 {
+			return "", fmt.Errorf("invalid color %q", word)
+		}
+		return fmt.Sprintf("%d;2;%d;%d;%d", extended, rgb>>16, rgb>>8&0xff, rgb&0xff), nil
+	}
+
+	if n, err := strconv.Atoi(word); err == nil {
+		if n < 0 || n > 255 {
+			return "", fmt.Errorf("invalid color %q", word)
+		}
+		return fmt.Sprintf("%d;5;%d", extended, n), nil
+	}
+
+	name, bright := strings.CutPrefix(word, "bright")
+	if i := slices.Index(colorNames, strings.TrimPrefix(name, "-")); i >= 0 {
+		if bright {
+			base += 60
+		}
+		return strconv.Itoa(base + i), nil
+	}
+
+	return "", fmt.Errorf("unknown color %q", word)
+}
+
+// tmuxStyle converts a valid color to a tmux style, e.g. "fg=red,bold".
+func tmuxStyle(color string) string {
+	var styles []string
+
+	colors := 0
+	for _, word := range strings.Fields(color) {
+		if name, _, off, ok := colorAttribute(word); ok {
+			if off {
+				styles = append(styles, "no"+tmuxAttributes[name])
+			} else {
+				styles = append(styles, tmuxAttributes[name])
+			}
+			continue
+		}
+
+		colors++
+		if word == "normal" {
+			continue
+		}
+
+		key := "fg"
+		if colors == 2 {
+			key = "bg"
+		}
+
+		if n, err := strconv.Atoi(word); err == nil {
+			word = fmt.Sprintf("colour%d", n)
+		}
+		styles = append(styles, key+"="+strings.Replace(word, "bright-", "bright", 1))
+	}
+
+	return strings.Join(styles, ",")
+}
+
+// gitColors reads the color.status.* git config of repo, falling back to the
+// given colors for keys that are unset or can't be parsed.
+func gitColors(repo Repo, fallback Colors) (Colors, error) {
+	configs := repo.gitConfig
+	if configs == nil {
+		var err error
+		if configs, err = readGitConfig(repo.Dir); err != nil {
+			return Colors{}, err
+		}
+	}
+	keys := configSection(configs, "color", "status")
+
+	colors := fallback
+	for key, color := range map[string]*string{
+		"branch":    &colors.Branch,
+		"added":     &colors.Staged,
+		"unmerged":  &colors.Conflict,
+		"changed":   &colors.Modified,
+		"untracked": &colors.Untracked,
+	} {
+		if value, ok := keys[key]; ok {
+			if _, err := ANSIColor(value); err == nil {
+				*color = value
+			}
+		}
+	}
+
+	return colors, nil
+}
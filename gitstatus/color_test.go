@@ -0,0 +1,76 @@
+package gitstatus
+
+import "testing"
+
+func TestANSIColor(t *testing.T) {
+	tests := []struct {
+		color, want string
+		wantErr     bool
+	}{
+		{"", "", false},
+		{"normal", "", false},
+		{"bold red", "\x1b[1;31m", false},
+		{"red nobold", "\x1b[31;22m", false},
+		{"no-dim noitalic no-ul noblink noreverse nostrike", "\x1b[22;23;24;25;27;29m", false},
+		{"reset green", "\x1b[0;32m", false},
+		{"brightblue default", "\x1b[94;49m", false},
+		{"208 #ff8700", "\x1b[38;5;208;48;2;255;135;0m", false},
+		{"noreset", "", true},
+		{"nocolor", "", true},
+		{"red green blue", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ANSIColor(tt.color)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ANSIColor(%q) = %q, %v, want %q, error %v", tt.color, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTmuxStyle(t *testing.T) {
+	tests := []struct {
+		color, want string
+	}{
+		{"bold red", "bold,fg=red"},
+		{"red nobold", "fg=red,nobold"},
+		{"no-italic ul", "noitalics,underscore"},
+		{"normal bright-blue", "bg=brightblue"},
+		{"208 nostrike", "fg=colour208,nostrikethrough"},
+		{"reset", "fg=default,bg=default,none"},
+	}
+
+	for _, tt := range tests {
+		if got := tmuxStyle(tt.color); got != tt.want {
+			t.Errorf("tmuxStyle(%q) = %q, want %q", tt.color, got, tt.want)
+		}
+	}
+}
+
+func TestGitColors(t *testing.T) {
+	dir := testRepo(t)
+	runTestGit(t, dir, "config", "color.status.changed", "red nobold")
+	runTestGit(t, dir, "config", "color.status.untracked", "red sparkly")
+
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "color.status.branch")
+	t.Setenv("GIT_CONFIG_VALUE_0", "magenta")
+
+	fallback := Colors{Modified: "yellow", Untracked: "blue", Staged: "green"}
+	want := Colors{Branch: "magenta", Modified: "red nobold", Untracked: "blue", Staged: "green"}
+	for _, section := range []string{"", "compactstatus"} {
+		// The config read along with the repository is reused
+		repo, err := LookupRepo(dir, section)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		colors, err := gitColors(repo, fallback)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if colors != want {
+			t.Errorf("gitColors() with section %q = %+v, want %+v", section, colors, want)
+		}
+	}
+}
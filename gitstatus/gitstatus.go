@@ -0,0 +1,2570 @@
+// Package gitstatus renders the status of a Git repository as a compact
+// prompt segment, like the compact-git-status command.
+package gitstatus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+// Status represents the status of a Git repository.
+type Status struct {
+	Commit    string `json:"commit"`
+	Unborn    bool   `json:"unborn"`
+	Branch    string `json:"branch"`
+	Upstream  string `json:"upstream"`
+	Bare      bool   `json:"bare"`
+	Ahead     int    `json:"ahead"`
+	Behind    int    `json:"behind"`
+	Staged    int    `json:"staged"`
+	Renamed   int    `json:"renamed"`
+	Conflict  int    `json:"conflict"`
+	Modified  int    `json:"modified"`
+	Deleted   int    `json:"deleted"`
+	Untracked int    `json:"untracked"`
+	Stashed   int    `json:"stashed"`
+
+	// IntentToAdd counts files added with git add -N, which are neither
+	// staged nor untracked.
+	IntentToAdd int `json:"intent_to_add"`
+
+	// Ignored is only counted with -show-ignored.
+	Ignored int `json:"ignored"`
+
+	// SubmodulesDirty counts submodules with new commits, modified content
+	// or untracked files.
+	SubmodulesDirty int `json:"submodules_dirty"`
+
+	// StagedDeleted is the part of Staged deleted from the index.
+	StagedDeleted int `json:"staged_deleted"`
+
+	// DeletedByUs and DeletedByThem are the parts of Conflict where one
+	// side deleted the file.
+	DeletedByUs   int `json:"deleted_by_us"`
+	DeletedByThem int `json:"deleted_by_them"`
+
+	LinesAdded   int `json:"lines_added"`
+	LinesRemoved int `json:"lines_removed"`
+
+	Files []File `json:"files,omitempty"`
+
+	Even bool `json:"even"`
+
+	// PushAhead and PushBehind count the commits relative to the push
+	// destination, with -show-push.
+	PushAhead  int `json:"push_ahead"`
+	PushBehind int `json:"push_behind"`
+
+	// Describe names a detached HEAD relative to the nearest tag, with
+	// -describe.
+	Describe string `json:"describe,omitempty"`
+
+	// Tag is the nearest tag reachable from HEAD and TagDistance the
+	// number of commits since it, with -show-tag.
+	Tag         string `json:"tag,omitempty"`
+	TagDistance int    `json:"tag_distance"`
+
+	// CommitTime is the committer time of HEAD as a Unix timestamp, with
+	// -show-age.
+	CommitTime int64 `json:"commit_time,omitempty"`
+
+	// Subject is the subject of the HEAD commit, with -show-subject.
+	Subject string `json:"subject,omitempty"`
+
+	// Signature is the signature status of HEAD as reported by git log
+	// %G?, e.g. G for good and N for none, with -show-signature.
+	Signature string `json:"signature,omitempty"`
+
+	// StashMessage is the subject of the most recent stash, with
+	// -show-stash-message.
+	StashMessage string `json:"stash_message,omitempty"`
+
+	// BaseAhead counts the commits HEAD is ahead of the base branch, with
+	// -show-base.
+	BaseAhead int `json:"base_ahead"`
+
+	// UpstreamGone is set when the upstream branch no longer exists.
+	UpstreamGone bool `json:"upstream_gone"`
+
+	WorktreeLocked bool `json:"worktree_locked"`
+
+	// IndexLocked is set while another git process holds the index lock.
+	IndexLocked bool `json:"index_locked"`
+
+	// Shallow is set in a shallow clone, where ahead/behind counts and
+	// describe output may be wrong as the history is incomplete.
+	Shallow bool `json:"shallow"`
+
+	// Sparse is the sparse-checkout mode, cone or pattern, and SparseIndex
+	// is set when the index is sparse too.
+	Sparse      string `json:"sparse,omitempty"`
+	SparseIndex bool   `json:"sparse_index"`
+
+	// Promisor is set in a partial clone, where missing objects are fetched
+	// from a promisor remote on demand.
+	Promisor bool `json:"promisor"`
+
+	// submodules are the paths of the submodules with modified content or
+	// untracked files.
+	submodules []string
+
+	// abMissing is set when an upstream is configured but git did not
+	// report ahead/behind counts for it.
+	abMissing bool
+}
+
+// File represents a changed file and its status code.
+type File struct {
+	Status   string `json:"status"`
+	Path     string `json:"path"`
+	OrigPath string `json:"orig_path,omitempty"`
+}
+
+// State represents the state of a Git repository during a specific operation.
+// The JSON field names are stable, and are empty or zero when no operation is
+// in progress.
+type State struct {
+	Step  int    `json:"state_step"`
+	Total int    `json:"state_total"`
+	State string `json:"state"`
+
+	Autostash bool `json:"autostash"`
+
+	// HeadName is the branch being rebased, which is empty when rebasing a
+	// detached HEAD.
+	HeadName string `json:"head_name,omitempty"`
+
+	// Onto is the commit being rebased onto, named relative to a ref when
+	// possible.
+	Onto string `json:"onto,omitempty"`
+
+	// Patch is the subject of the patch being applied by git am.
+	Patch string `json:"patch,omitempty"`
+
+	// Merge is the branch being merged.
+	Merge string `json:"merge,omitempty"`
+
+	// BisectGood and BisectBad count the commits marked during a bisect,
+	// and BisectSteps estimates the steps left once both are marked.
+	BisectGood  int `json:"bisect_good"`
+	BisectBad   int `json:"bisect_bad"`
+	BisectSteps int `json:"bisect_steps"`
+
+	// Todo counts the remaining actions of an interactive rebase by name,
+	// e.g. pick or squash.
+	Todo map[string]int `json:"todo,omitempty"`
+}
+
+// Output represents the structured output of the program.
+type Output struct {
+	Status
+	State
+
+	Raw string `json:"raw,omitempty"`
+}
+
+const (
+	RebaseApply       string = "REBASE"
+	RebaseMerge              = "REBASE-m"
+	RebaseInteractive        = "REBASE-i"
+	Am                       = "AM"
+	AmRebase                 = "AM/REBASE"
+	Merging                  = "MERGING"
+	CherryPick               = "CHERRY-PICKING"
+	Reverting                = "REVERTING"
+	Bisecting                = "BISECTING"
+	StashConflict            = "STASH-CONFLICT"
+)
+
+// todoActions are the interactive rebase actions in display order, by their
+// abbreviations.
+var todoActions = []struct {
+	abbrev, name string
+}{
+	{"p", "pick"},
+	{"r", "reword"},
+	{"e", "edit"},
+	{"s", "squash"},
+	{"f", "fixup"},
+	{"x", "exec"},
+	{"b", "break"},
+	{"d", "drop"},
+	{"l", "label"},
+	{"t", "reset"},
+	{"m", "merge"},
+	{"u", "update-ref"},
+}
+
+// Positions of the operation state segment.
+const (
+	StatePositionAfterBranch = "after-branch"
+	StatePositionEnd         = "end"
+)
+
+// Positions of the local branch symbol relative to the branch name.
+const (
+	LocalPositionAfter  = "after"
+	LocalPositionBefore = "before"
+	LocalPositionNone   = "none"
+)
+
+// compactStates maps each state to its abbreviation.
+var compactStates = map[string]string{
+	RebaseApply:       "RB",
+	RebaseMerge:       "RB-m",
+	RebaseInteractive: "RB-i",
+	Am:                "AM",
+	AmRebase:          "AM/RB",
+	Merging:           "MG",
+	CherryPick:        "CP",
+	Reverting:         "RV",
+	Bisecting:         "BS",
+	StashConflict:     "SC",
+}
+
+// StateLabels is a flag.Value of labels replacing the state names, written
+// as a comma separated list of STATE=LABEL pairs.
+type StateLabels map[string]string
+
+// String returns the labels as a comma separated list of STATE=LABEL pairs.
+func (l StateLabels) String() string {
+	var pairs []string
+	for state, label := range l {
+		pairs = append(pairs, state+"="+label)
+	}
+	slices.Sort(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// Set adds the comma separated STATE=LABEL pairs to the labels.
+func (l StateLabels) Set(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		state, label, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("expected STATE=LABEL, got %q", pair)
+		}
+		if _, ok := compactStates[state]; !ok {
+			return fmt.Errorf("unknown state %q", state)
+		}
+		l[state] = label
+	}
+
+	return nil
+}
+
+// SubjectLength is a flag.Value for the length of subjects shown with
+// -show-subject and -show-stash-message, which can also be passed without a
+// length.
+type SubjectLength int
+
+// DefaultSubjectLength is the subject length when none is given.
+const DefaultSubjectLength = 50
+
+// IsBoolFlag allows the flag to be passed without a value.
+func (l *SubjectLength) IsBoolFlag() bool {
+	return true
+}
+
+// String returns the subject length.
+func (l *SubjectLength) String() string {
+	return strconv.Itoa(int(*l))
+}
+
+// Set sets the subject length from a number, or a boolean for the default
+// length or none.
+func (l *SubjectLength) Set(s string) error {
+	if n, err := strconv.Atoi(s); err == nil {
+		*l = SubjectLength(max(0, n))
+		return nil
+	}
+
+	show, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("expected a length or boolean, got %q", s)
+	}
+
+	*l = 0
+	if show {
+		*l = DefaultSubjectLength
+	}
+	return nil
+}
+
+// TemplateData is the data available to -format templates.
+type TemplateData struct {
+	Status  Status
+	State   State
+	Symbols Symbols
+}
+
+// ErrParse is returned when the git status output can't be parsed.
+var ErrParse = errors.New("parse status")
+
+// Symbols represents the symbols used to display the Git repository status.
+type Symbols struct {
+	Prefix    string
+	Suffix    string
+	Sep       string
+	StateSep  string
+	Local     string
+	LocalSep  string
+	Ahead     string
+	Behind    string
+	PushHint  string
+	PullHint  string
+	SyncHint  string
+	Even      string
+	Gone      string
+	Push      string
+	Base      string
+	Tag       string
+	Signed    string
+	Unsigned  string
+	Locked    string
+	IndexLock string
+	Shallow   string
+	Sparse    string
+	Promisor  string
+	Protected string
+	Hash      string
+	Staged    string
+	Renamed   string
+	Conflict  string
+	Modified  string
+	Deleted   string
+	Intent    string
+	Untracked string
+	Ignored   string
+	Submodule string
+	Stashed   string
+	Autostash string
+	Dirty     string
+	Clean     string
+	Nop       string
+	Powerline string
+	Branch    string
+
+	StagedDeleted string
+	DeletedByUs   string
+	DeletedByThem string
+	BadSignature  string
+	SparseIndex   string
+}
+
+// Flags configures what is rendered and how. The zero value renders without
+// symbols, and empty modes such as Color or LocalPosition stand for their
+// defaults; DefaultFlags returns the defaults of the command.
+type Flags struct {
+	Path              string
+	ShowUpstream      bool
+	StashIgnoresClean bool
+	JSON              bool
+	IconsOnly         bool
+	ShowHints         bool
+	ComputeAB         bool
+	Churn             bool
+	MaxCount          int
+	ShowAutostash     bool
+	GitColors         bool
+	Color             string
+	Shell             string
+	Output            string
+	StateLabels       StateLabels
+	NoStash           bool
+	NoUntracked       bool
+	NoUpstream        bool
+	NoState           bool
+	ShowIgnored       bool
+	RecurseSubmodules bool
+	ShowPush          bool
+	ShowBase          bool
+	Describe          bool
+	ShowTag           bool
+	ShowAge           bool
+	ShowSignature     bool
+	ShowSparseIndex   bool
+	ShowTodo          bool
+	Verbose           bool
+	Backend           string
+	VerboseFiles      int
+	PatchLength       int
+	ShowStashMessage  SubjectLength
+	BranchStashes     bool
+	ShowSubject       SubjectLength
+	StaleAfter        time.Duration
+	Base              string
+	Files             bool
+	CheckEven         bool
+	BehindFirst       bool
+	HideOpDetached    bool
+	GroupDigits       bool
+	DigitSep          string
+	EmptyBrackets     bool
+	SplitModified     bool
+	NoBranch          bool
+	Against           string
+	StashFallback     bool
+	CompactState      bool
+	HideClean         bool
+	ProtectedBranches string
+	StatePosition     string
+	IncludeRaw        bool
+	ABFraction        bool
+	UntrackedIsClean  bool
+	Superproject      bool
+	BareLabel         string
+	ShowHash          bool
+	HashLength        int
+	FixedWidth        int
+	LocalPosition     string
+	ShowStashConflict bool
+	Summary           bool
+	Powerline         bool
+	Format            string
+
+	JSONNumbersAsStrings bool
+
+	Symbols Symbols
+	Colors  Colors
+}
+
+// DefaultFlags returns the flags the command renders with by default.
+func DefaultFlags() Flags {
+	return Flags{
+		Color:         ColorAuto,
+		Output:        OutputANSI,
+		Backend:       BackendGit,
+		StatePosition: StatePositionAfterBranch,
+		LocalPosition: LocalPositionAfter,
+		DigitSep:      ",",
+		StaleAfter:    7 * 24 * time.Hour,
+		Base:          "origin/HEAD",
+		PatchLength:   DefaultSubjectLength,
+		BareLabel:     "BARE",
+		HashLength:    7,
+		VerboseFiles:  10,
+		Symbols: Symbols{
+			Prefix:       "[",
+			Suffix:       "]",
+			Sep:          "|",
+			Local:        "L",
+			LocalSep:     " ",
+			Renamed:      "» ",
+			Modified:     "✚ ",
+			Deleted:      "⊖ ",
+			Staged:       "● ",
+			Conflict:     "✖ ",
+			Intent:       "⊕ ",
+			Untracked:    "…",
+			Ignored:      "⊘ ",
+			Submodule:    "◈ ",
+			Stashed:      "⚑ ",
+			Autostash:    "+stash",
+			Ahead:        "↑·",
+			Behind:       "↓·",
+			PushHint:     "⇡",
+			PullHint:     "⇣",
+			SyncHint:     "⇅",
+			Push:         "⇢",
+			Signed:       "⚿",
+			BadSignature: "⚿!",
+			Tag:          "⌂",
+			Base:         "Δ",
+			Gone:         "✗",
+			Even:         "≡",
+			Locked:       "🔒",
+			IndexLock:    "⧗",
+			Shallow:      "◌",
+			Sparse:       "◫",
+			Promisor:     "☁",
+			SparseIndex:  "◫ⁱ",
+			Protected:    "⚠",
+			Hash:         "@",
+			Clean:        "✔",
+			Nop:          " ",
+			Powerline:    "\ue0b0",
+		},
+	}
+}
+
+// withDefaultModes returns flags with the empty modes set to their defaults,
+// and the auto color mode resolved for stdout.
+func withDefaultModes(flags Flags) Flags {
+	for _, mode := range []struct {
+		value    *string
+		fallback string
+	}{
+		{&flags.Color, ColorAuto},
+		{&flags.Output, OutputANSI},
+		{&flags.Backend, BackendGit},
+		{&flags.StatePosition, StatePositionAfterBranch},
+		{&flags.LocalPosition, LocalPositionAfter},
+	} {
+		if *mode.value == "" {
+			*mode.value = mode.fallback
+		}
+	}
+
+	if flags.Color == ColorAuto {
+		// Like the command, only color output going to a terminal, or to
+		// tmux which interprets its own style directives
+		flags.Color = ColorNever
+		if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 || flags.Output == OutputTmux {
+			flags.Color = ColorAlways
+		}
+	}
+
+	return flags
+}
+
+// Render renders the status of the Git repository at path. It has no global
+// side effects, so it is safe to call concurrently.
+func Render(path string, flags Flags) (string, error) {
+	repo, err := LookupRepo(path, "")
+	if err != nil {
+		return "", err
+	}
+
+	output, _, err := RenderRepo(repo, flags)
+	return output, err
+}
+
+// RenderRepo renders the status of a repository looked up with LookupRepo, and
+// also returns the status it rendered, which is nil if the repository was not
+// found.
+func RenderRepo(repo Repo, flags Flags) (string, *Status, error) {
+	flags = withDefaultModes(flags)
+
+	path := repo.Path
+	if flags.Superproject {
+		// Not being in a submodule, or a repository at all, is not an error
+		if stdout, err := runGit(path, "rev-parse", "--show-superproject-working-tree"); err == nil && strings.TrimSpace(stdout) != "" {
+			var err error
+			if repo, err = LookupRepo(strings.TrimSpace(stdout), ""); err != nil {
+				return "", nil, err
+			}
+			path = repo.Path
+		}
+	}
+
+	if repo.Dir == "" || !repo.Bare && repo.TopLevel == "" {
+		// Empty git dir means not in a git repository, and no working tree
+		// outside a bare one means inside a Git directory, e.g. .git, which
+		// has no status either
+		if flags.JSON {
+			return "null", nil, nil
+		}
+		if flags.EmptyBrackets {
+			return flags.Symbols.Prefix + flags.Symbols.Suffix, nil, nil
+		}
+		return flags.Symbols.Nop, nil, nil
+	}
+
+	state, err := gitState(repo.Dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if state.State == CherryPick || state.State == Reverting {
+		if state.Step, state.Total, err = gitSequencerProgress(path, repo.Dir); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if state.State == Bisecting {
+		if state.BisectGood, state.BisectBad, state.BisectSteps, err = gitBisectProgress(path, repo.Dir); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if state.State == Merging && state.Merge == "" {
+		// Best effort, keep no name if MERGE_HEAD can't be named
+		if name, err := runGit(path, "name-rev", "--name-only", "--always", "MERGE_HEAD"); err == nil {
+			state.Merge = strings.TrimSpace(name)
+		}
+	}
+
+	if state.Onto != "" {
+		// Best effort, keep the hash if it can't be named
+		if name, err := runGit(path, "name-rev", "--name-only", "--always", state.Onto); err == nil {
+			state.Onto = strings.TrimSpace(name)
+		}
+	}
+
+	var status *Status
+	var output string
+	if repo.Bare {
+		// There is no working tree, but HEAD may still name a branch
+		status = &Status{Bare: true}
+		if branch, err := runGit(path, "symbolic-ref", "--short", "-q", "HEAD"); err == nil {
+			status.Branch = strings.TrimSpace(branch)
+		}
+	} else {
+		status, output, err = workTreeStatus(path, repo.Dir, flags)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	if flags.ShowStashConflict && state.State == "" && status.Conflict > 0 && status.Stashed > 0 {
+		common, err := commonDir(repo.Dir)
+		if err != nil {
+			return "", nil, err
+		}
+		if stashConflict(repo.Dir, common) {
+			state.State = StashConflict
+		}
+	}
+
+	if flags.NoState {
+		state = &State{}
+	}
+
+	if err := validateColors(flags.Colors); err != nil {
+		return "", nil, err
+	}
+
+	if flags.GitColors {
+		colors, err := gitColors(repo, flags.Colors)
+		if err != nil {
+			return "", nil, err
+		}
+		flags.Colors = colors
+	}
+
+	if flags.Color == ColorNever {
+		flags.Colors = Colors{}
+	}
+
+	if flags.JSON {
+		o := Output{Status: *status, State: *state}
+		if flags.IncludeRaw {
+			o.Raw = output
+		}
+		if !flags.Files {
+			// The files are only kept for -verbose
+			o.Files = nil
+		}
+
+		b, err := json.Marshal(o)
+		if err != nil {
+			return "", nil, fmt.Errorf("marshal json: %w", err)
+		}
+
+		if flags.JSONNumbersAsStrings {
+			if b, err = quoteJSONNumbers(b); err != nil {
+				return "", nil, err
+			}
+		}
+		return string(b), status, nil
+	}
+
+	if state.HeadName != "" && status.Branch == "(detached)" {
+		// Show the branch being rebased in place of the detached HEAD, like
+		// git's own prompt
+		status.Branch = state.HeadName
+
+		// Best effort, the branch may have no upstream
+		if upstream, err := runGit(path, "rev-parse", "--abbrev-ref", state.HeadName+"@{upstream}"); err == nil {
+			status.Upstream = strings.TrimSpace(upstream)
+		}
+	}
+
+	if flags.Format != "" {
+		output, err := buildTemplate(*status, *state, flags)
+		if err != nil {
+			return "", nil, err
+		}
+		return output, status, nil
+	}
+
+	if flags.Summary {
+		return buildSummary(*status, *state, flags), status, nil
+	}
+
+	if flags.Powerline {
+		return buildPowerline(*status, *state, flags), status, nil
+	}
+
+	if flags.Verbose {
+		return buildOutput(*status, *state, flags) + buildVerbose(*status, flags), status, nil
+	}
+
+	return buildOutput(*status, *state, flags), status, nil
+}
+
+// quoteJSONNumbers rewrites every number in the JSON document b as a string.
+func quoteJSONNumbers(b []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+
+	var quote func(v any) any
+	quote = func(v any) any {
+		switch v := v.(type) {
+		case json.Number:
+			return v.String()
+		case map[string]any:
+			for k, e := range v {
+				v[k] = quote(e)
+			}
+		case []any:
+			for i, e := range v {
+				v[i] = quote(e)
+			}
+		}
+		return v
+	}
+
+	b, err := json.Marshal(quote(v))
+	if err != nil {
+		return nil, fmt.Errorf("marshal json: %w", err)
+	}
+
+	return b, nil
+}
+
+// workTreeStatus retrieves the status of the working tree at path, along with
+// the raw git status output it was parsed from.
+func workTreeStatus(path, dir string, flags Flags) (*Status, string, error) {
+	var output string
+	var err error
+	if flags.Backend == BackendNative {
+		output, err = nativeStatus(path, dir, flags)
+	} else {
+		output, err = gitStatus(path, statusArgs(flags))
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	status, err := parseStatus(output)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrParse, err)
+	}
+
+	if flags.RecurseSubmodules {
+		if err := addSubmodules(status, path, flags); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if !flags.Files && !flags.Verbose {
+		status.Files = nil
+	}
+
+	// Linked worktrees have a commondir pointing back at the main repository
+	status.WorktreeLocked = pathExists(filepath.Join(dir, "commondir")) && pathExists(filepath.Join(dir, "locked"))
+
+	// Git status still works without taking the lock, it just can't refresh
+	// the index
+	status.IndexLocked = pathExists(filepath.Join(dir, "index.lock"))
+
+	common, err := commonDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	status.Shallow = pathExists(filepath.Join(common, "shallow"))
+
+	// Packs fetched from a promisor remote are marked with a .promisor file
+	promisors, err := filepath.Glob(filepath.Join(common, "objects", "pack", "*.promisor"))
+	if err != nil {
+		return nil, "", fmt.Errorf("find promisor packs: %w", err)
+	}
+	status.Promisor = len(promisors) > 0
+
+	// Only check the config when there are sparse-checkout patterns
+	if pathExists(filepath.Join(dir, "info", "sparse-checkout")) {
+		config, err := gitConfigBools(path, `^(core\.sparsecheckout|core\.sparsecheckoutcone|index\.sparse)$`)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if config["core.sparsecheckout"] {
+			status.Sparse = "pattern"
+			if config["core.sparsecheckoutcone"] {
+				status.Sparse = "cone"
+			}
+			// The index can only be sparse in cone mode
+			status.SparseIndex = status.Sparse == "cone" && config["index.sparse"]
+		}
+	}
+
+	if flags.StashFallback && !flags.NoStash && status.Stashed == 0 {
+		// Older git does not print the stash header with --show-stash
+		stashes, err := runGit(path, "stash", "list")
+		if err != nil {
+			return nil, "", err
+		}
+		status.Stashed = countLines(stashes)
+	}
+
+	if flags.Against != "" {
+		staged, modified, err := gitDiffAgainst(path, flags.Against)
+		if err != nil {
+			return nil, "", err
+		}
+		status.Staged = staged
+		status.Modified = modified
+		// The working tree diff already includes deletions
+		status.Deleted = 0
+	}
+
+	if flags.NoUpstream {
+		status.Ahead = 0
+		status.Behind = 0
+	}
+
+	// Git omits the ahead/behind counts when the upstream is gone
+	status.UpstreamGone = status.abMissing && !status.Unborn && !flags.NoUpstream
+
+	if flags.ComputeAB && !flags.NoUpstream && status.abMissing {
+		// Best effort, keep zero counts if the upstream can't be resolved
+		if ahead, behind, err := gitAheadBehind(path, "@{u}"); err == nil {
+			status.Ahead = ahead
+			status.Behind = behind
+			status.UpstreamGone = false
+		}
+	}
+
+	if flags.ShowPush && !flags.NoUpstream && !status.Unborn {
+		// Best effort, there may be no push destination. It is only
+		// interesting when it differs from the upstream.
+		if push, err := runGit(path, "rev-parse", "--abbrev-ref", "@{push}"); err == nil && strings.TrimSpace(push) != status.Upstream {
+			if ahead, behind, err := gitAheadBehind(path, "@{push}"); err == nil {
+				status.PushAhead = ahead
+				status.PushBehind = behind
+			}
+		}
+	}
+
+	if flags.Describe && status.Branch == "(detached)" && !status.Unborn {
+		describe, err := runGit(path, "describe", "--tags", "--always")
+		if err != nil {
+			return nil, "", fmt.Errorf("describe: %w", err)
+		}
+		status.Describe = strings.TrimSpace(describe)
+	}
+
+	if flags.ShowTag && !status.Unborn {
+		// Best effort, there may be no tag to describe HEAD with
+		if describe, err := runGit(path, "describe", "--tags", "--long"); err == nil {
+			status.Tag, status.TagDistance, err = parseDescribe(strings.TrimSpace(describe))
+			if err != nil {
+				return nil, "", fmt.Errorf("%w: %w", ErrParse, err)
+			}
+		}
+	}
+
+	if flags.ShowAge && !status.Unborn {
+		timestamp, err := runGit(path, "log", "-1", "--format=%ct")
+		if err != nil {
+			return nil, "", fmt.Errorf("get commit time: %w", err)
+		}
+		if status.CommitTime, err = strconv.ParseInt(strings.TrimSpace(timestamp), 10, 64); err != nil {
+			return nil, "", fmt.Errorf("%w: parse commit time: %w", ErrParse, err)
+		}
+	}
+
+	if flags.ShowSubject > 0 && !status.Unborn {
+		subject, err := runGit(path, "log", "-1", "--format=%s")
+		if err != nil {
+			return nil, "", fmt.Errorf("get subject: %w", err)
+		}
+		status.Subject = strings.TrimSpace(subject)
+	}
+
+	if flags.ShowSignature && !status.Unborn {
+		signature, err := runGit(path, "log", "-1", "--format=%G?")
+		if err != nil {
+			return nil, "", fmt.Errorf("get signature: %w", err)
+		}
+		status.Signature = strings.TrimSpace(signature)
+	}
+
+	if flags.BranchStashes && status.Stashed > 0 {
+		stashes, err := runGit(path, "stash", "list", "--format=%gs")
+		if err != nil {
+			return nil, "", fmt.Errorf("list stashes: %w", err)
+		}
+
+		branch := status.Branch
+		if branch == "(detached)" {
+			branch = "(no branch)"
+		}
+
+		var messages []string
+		for _, message := range strings.Split(stashes, "\n") {
+			// Stashes are named "WIP on <branch>: ..." or "On <branch>: ..."
+			name := strings.TrimPrefix(strings.TrimPrefix(message, "WIP on "), "On ")
+			if strings.HasPrefix(name, branch+": ") {
+				messages = append(messages, message)
+			}
+		}
+
+		status.Stashed = len(messages)
+		if flags.ShowStashMessage > 0 && len(messages) > 0 {
+			status.StashMessage = messages[0]
+		}
+	}
+
+	if flags.ShowStashMessage > 0 && !flags.BranchStashes && status.Stashed > 0 {
+		message, err := runGit(path, "log", "-1", "--format=%s", "refs/stash")
+		if err != nil {
+			return nil, "", fmt.Errorf("get stash message: %w", err)
+		}
+		status.StashMessage = strings.TrimSpace(message)
+	}
+
+	if flags.ShowBase && !status.Unborn {
+		// Best effort, the base may not exist
+		if base, err := gitResolveCommit(path, flags.Base); err == nil {
+			if ahead, _, err := gitAheadBehind(path, base); err == nil {
+				status.BaseAhead = ahead
+			}
+		}
+	}
+
+	if flags.CheckEven && !flags.NoUpstream && status.Upstream != "" && !status.Unborn {
+		// Best effort, an unresolvable upstream is never even
+		if oid, err := runGit(path, "rev-parse", "@{u}"); err == nil {
+			status.Even = strings.TrimSpace(oid) == status.Commit
+		}
+	}
+
+	if flags.Churn {
+		added, removed, err := gitChurn(path)
+		if err != nil {
+			return nil, "", err
+		}
+		status.LinesAdded = added
+		status.LinesRemoved = removed
+	}
+
+	return status, output, nil
+}
+
+// parseDescribe parses git describe --long output, <tag>-<n>-g<hash>, into
+// the tag and the number of commits since it.
+func parseDescribe(describe string) (string, int, error) {
+	// The hash is hexadecimal, so the last "-g" precedes it
+	rest := describe[:max(0, strings.LastIndex(describe, "-g"))]
+
+	i := strings.LastIndex(rest, "-")
+	if i < 0 {
+		return "", 0, fmt.Errorf("parse describe %q", describe)
+	}
+
+	distance, err := strconv.Atoi(rest[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("parse describe distance: %w", err)
+	}
+
+	return rest[:i], distance, nil
+}
+
+// statusArgs returns the git status arguments for the flags.
+func statusArgs(flags Flags) []string {
+	// Refreshing the index takes its lock, which would get in the way of
+	// other git processes, including concurrent prompts
+	args := []string{"--no-optional-locks", "status", "--porcelain=2", "--branch"}
+	if !flags.NoStash {
+		args = append(args, "--show-stash")
+	}
+	if flags.NoUntracked {
+		// Skipping untracked files also saves scanning for them
+		args = append(args, "--untracked-files=no")
+	}
+	if flags.ShowIgnored {
+		args = append(args, "--ignored")
+	}
+
+	return args
+}
+
+// addSubmodules adds the file counts of the dirty submodules of the working
+// tree at path to status, recursing into nested submodules.
+func addSubmodules(status *Status, path string, flags Flags) error {
+	for _, submodule := range status.submodules {
+		output, err := gitStatus(filepath.Join(path, submodule), statusArgs(flags))
+		if err != nil {
+			return fmt.Errorf("submodule %s: %w", submodule, err)
+		}
+
+		sub, err := parseStatus(output)
+		if err != nil {
+			return fmt.Errorf("%w: submodule %s: %w", ErrParse, submodule, err)
+		}
+
+		if err := addSubmodules(sub, filepath.Join(path, submodule), flags); err != nil {
+			return err
+		}
+
+		status.Staged += sub.Staged
+		status.StagedDeleted += sub.StagedDeleted
+		status.Renamed += sub.Renamed
+		status.Conflict += sub.Conflict
+		status.Modified += sub.Modified
+		status.Deleted += sub.Deleted
+		status.IntentToAdd += sub.IntentToAdd
+		status.Untracked += sub.Untracked
+		status.Ignored += sub.Ignored
+		status.SubmodulesDirty += sub.SubmodulesDirty
+
+		for _, f := range sub.Files {
+			f.Path = filepath.Join(submodule, f.Path)
+			if f.OrigPath != "" {
+				f.OrigPath = filepath.Join(submodule, f.OrigPath)
+			}
+			status.Files = append(status.Files, f)
+		}
+	}
+
+	return nil
+}
+
+// runGit runs git with the given arguments in path and returns its stdout.
+func runGit(path string, args ...string) (string, error) {
+	stdout, err := exec.Command("git", append([]string{"-C", path}, args...)...).Output()
+	if err != nil {
+		var e *exec.ExitError
+		if errors.As(err, &e) && len(e.Stderr) > 0 {
+			return "", fmt.Errorf("run cmd: %w: %s", err, strings.TrimSpace(string(e.Stderr)))
+		}
+		return "", fmt.Errorf("run cmd: %w", err)
+	}
+
+	return string(stdout), nil
+}
+
+// Repo describes the Git repository containing a path.
+type Repo struct {
+	// Path is the path the repository was looked up from.
+	Path string
+
+	// Dir is the absolute path of the Git directory, or an empty string if
+	// Path is not inside a Git repository.
+	Dir  string
+	Bare bool
+
+	// TopLevel is the top level of the working tree, or an empty string if
+	// Path is not inside one.
+	TopLevel string
+
+	// Config holds the keys of the git config section read along with the
+	// repository, without the section name.
+	Config map[string]string
+
+	// gitConfig is the git config read along with the repository, if any,
+	// which is reused for the color.status.* keys.
+	gitConfig []*format.Config
+}
+
+// LookupRepo looks up the repository containing path like git does, without
+// running it, reading the keys of the git config section along with it.
+func LookupRepo(path, section string) (Repo, error) {
+	repo, err := findRepo(path)
+	if err != nil || section == "" {
+		return repo, err
+	}
+
+	// The config is read outside a repository too, like git config does
+	configs, err := readGitConfig(repo.Dir)
+	if err != nil {
+		return Repo{}, err
+	}
+	repo.Config = configSection(configs, section, "")
+	repo.gitConfig = configs
+
+	return repo, nil
+}
+
+// findRepo finds the Git directory and working tree containing path, honoring
+// GIT_DIR, GIT_WORK_TREE and GIT_CEILING_DIRECTORIES.
+func findRepo(path string) (Repo, error) {
+	start, err := filepath.Abs(path)
+	if err != nil {
+		return Repo{}, fmt.Errorf("resolve path: %w", err)
+	}
+
+	if dir := os.Getenv("GIT_DIR"); dir != "" {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(start, dir)
+		}
+		if !isGitDir(dir) {
+			return Repo{Path: path}, nil
+		}
+
+		// Without a work tree, the current directory is its top level
+		// unless the repository is bare
+		worktree := os.Getenv("GIT_WORK_TREE")
+		if worktree != "" && !filepath.IsAbs(worktree) {
+			worktree = filepath.Join(start, worktree)
+		}
+		return setupRepo(path, filepath.Clean(dir), start, worktree)
+	}
+
+	ceiling := ceilingDir(start)
+	for dir := start; ; {
+		dotGit := filepath.Join(dir, ".git")
+		info, err := os.Stat(dotGit)
+		switch {
+		case err == nil && info.IsDir() && isGitDir(dotGit):
+			return setupRepo(path, dotGit, dir, "")
+		case err == nil && !info.IsDir():
+			// Linked worktrees and submodules have a .git file pointing at
+			// their Git directory
+			b, err := os.ReadFile(dotGit)
+			if err != nil {
+				return Repo{}, fmt.Errorf("read .git: %w", err)
+			}
+
+			gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(b)), "gitdir: ")
+			if !ok {
+				return Repo{}, fmt.Errorf("invalid .git file %s", dotGit)
+			}
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			return setupRepo(path, filepath.Clean(gitDir), dir, "")
+		case err != nil && !errors.Is(err, os.ErrNotExist):
+			return Repo{}, fmt.Errorf("stat .git: %w", err)
+		}
+
+		if isGitDir(dir) {
+			// A Git directory found by itself has no working tree, and is
+			// bare unless core.bare says otherwise, as inside .git
+			common, err := commonDir(dir)
+			if err != nil {
+				return Repo{}, err
+			}
+			config, err := readGitConfigFile(filepath.Join(common, "config"))
+			if err != nil {
+				return Repo{}, err
+			}
+			bare := config.Section("core").Option("bare")
+			return Repo{Path: path, Dir: dir, Bare: bare == "" || gitBool(bare)}, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir || len(parent) <= len(ceiling) {
+			return Repo{Path: path}, nil
+		}
+		dir = parent
+	}
+}
+
+// setupRepo returns the repository with the Git directory dir, whose working
+// tree is worktree if not empty, or else core.worktree or topLevel unless
+// core.bare is set.
+func setupRepo(path, dir, topLevel, worktree string) (Repo, error) {
+	common, err := commonDir(dir)
+	if err != nil {
+		return Repo{}, err
+	}
+
+	config, err := readGitConfigFile(filepath.Join(common, "config"))
+	if err != nil {
+		return Repo{}, err
+	}
+	core := config.Section("core")
+
+	repo := Repo{Path: path, Dir: dir}
+	switch {
+	case worktree != "":
+		repo.TopLevel = filepath.Clean(worktree)
+	case core.Option("worktree") != "":
+		// core.worktree is relative to the Git directory
+		repo.TopLevel = core.Option("worktree")
+		if !filepath.IsAbs(repo.TopLevel) {
+			repo.TopLevel = filepath.Join(dir, repo.TopLevel)
+		}
+	case gitBool(core.Option("bare")):
+		repo.Bare = true
+	default:
+		repo.TopLevel = topLevel
+	}
+
+	return repo, nil
+}
+
+// isGitDir reports whether dir looks like a Git directory.
+func isGitDir(dir string) bool {
+	common, err := commonDir(dir)
+	return err == nil && pathExists(filepath.Join(dir, "HEAD")) && pathExists(filepath.Join(common, "objects")) && pathExists(filepath.Join(common, "refs"))
+}
+
+// ceilingDir returns the deepest of the GIT_CEILING_DIRECTORIES above dir,
+// which the lookup does not move up into, or an empty string if there is
+// none.
+func ceilingDir(dir string) string {
+	ceiling := ""
+	for _, c := range filepath.SplitList(os.Getenv("GIT_CEILING_DIRECTORIES")) {
+		// Like git, relative entries are ignored
+		if !filepath.IsAbs(c) {
+			continue
+		}
+
+		c = filepath.Clean(c)
+		rel, err := filepath.Rel(c, dir)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(c) > len(ceiling) {
+			ceiling = c
+		}
+	}
+
+	return ceiling
+}
+
+// readGitConfig reads the system, global and repository config, in
+// increasing precedence, followed by the config passed in GIT_CONFIG_COUNT
+// environment variables. dir is the Git directory, or an empty string outside
+// of a repository. Includes are not followed.
+func readGitConfig(dir string) ([]*format.Config, error) {
+	var files []string
+	if !gitBool(os.Getenv("GIT_CONFIG_NOSYSTEM")) {
+		system := os.Getenv("GIT_CONFIG_SYSTEM")
+		if system == "" {
+			system = "/etc/gitconfig"
+		}
+		files = append(files, system)
+	}
+
+	if global, ok := os.LookupEnv("GIT_CONFIG_GLOBAL"); ok {
+		if global != "" {
+			files = append(files, global)
+		}
+	} else if home, err := os.UserHomeDir(); err == nil {
+		xdg := os.Getenv("XDG_CONFIG_HOME")
+		if xdg == "" {
+			xdg = filepath.Join(home, ".config")
+		}
+		files = append(files, filepath.Join(xdg, "git", "config"), filepath.Join(home, ".gitconfig"))
+	}
+
+	if dir != "" {
+		common, err := commonDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, filepath.Join(common, "config"))
+	}
+
+	configs := make([]*format.Config, 0, len(files)+1)
+	for _, file := range files {
+		config, err := readGitConfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+
+	env := format.New()
+	count, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	for i := range count {
+		// Keys are section[.subsection].name, where only the subsection
+		// can contain dots
+		key := os.Getenv(fmt.Sprintf("GIT_CONFIG_KEY_%d", i))
+		section, rest, _ := strings.Cut(key, ".")
+		subsection, name := "", rest
+		if i := strings.LastIndex(rest, "."); i >= 0 {
+			subsection, name = rest[:i], rest[i+1:]
+		}
+		env.AddOption(section, subsection, name, os.Getenv(fmt.Sprintf("GIT_CONFIG_VALUE_%d", i)))
+	}
+
+	return append(configs, env), nil
+}
+
+// readGitConfigFile reads the git config file at path, which is empty if it
+// does not exist.
+func readGitConfigFile(path string) (*format.Config, error) {
+	config := format.New()
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	defer f.Close()
+
+	if err := format.NewDecoder(f).Decode(config); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// configSection returns the keys of a git config section, or of one of its
+// subsections, by their lowercase names.
+func configSection(configs []*format.Config, section, subsection string) map[string]string {
+	keys := make(map[string]string)
+	for _, c := range configs {
+		if !c.HasSection(section) {
+			continue
+		}
+
+		options := c.Section(section).Options
+		if subsection != "" {
+			if !c.Section(section).HasSubsection(subsection) {
+				continue
+			}
+			options = c.Section(section).Subsection(subsection).Options
+		}
+
+		// Like git, the last value of a key takes precedence
+		for _, option := range options {
+			keys[strings.ToLower(option.Key)] = option.Value
+		}
+	}
+
+	return keys
+}
+
+// gitBool reports whether value is a true git boolean.
+func gitBool(value string) bool {
+	return slices.Contains([]string{"true", "yes", "on", "1"}, strings.ToLower(value))
+}
+
+// gitConfigBools retrieves the boolean git config keys matching the regular
+// expression pattern, by their lowercase names. Unset keys are omitted.
+func gitConfigBools(path, pattern string) (map[string]bool, error) {
+	stdout, err := runGit(path, "config", "--type=bool", "--get-regexp", pattern)
+	if err != nil {
+		// Exit code 1 means no key matched
+		var e *exec.ExitError
+		if errors.As(err, &e) && e.ExitCode() == 1 {
+			return map[string]bool{}, nil
+		}
+		return nil, fmt.Errorf("get config %s: %w", pattern, err)
+	}
+
+	config := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		// The last value of a key takes precedence
+		key, value, _ := strings.Cut(line, " ")
+		config[key] = value == "true"
+	}
+
+	return config, nil
+}
+
+// gitState retrieves the current state of the Git repository in dir.
+func gitState(dir string) (*State, error) {
+	state := &State{State: ""}
+	switch {
+	case pathExists(filepath.Join(dir, "rebase-merge")):
+		step, err := readInt(filepath.Join(dir, "rebase-merge", "msgnum"))
+		if err != nil {
+			return nil, fmt.Errorf("read rebase-merge/msgnum: %w", err)
+		}
+		state.Step = step
+
+		total, err := readInt(filepath.Join(dir, "rebase-merge", "end"))
+		if err != nil {
+			return nil, fmt.Errorf("read rebase-merge/end: %w", err)
+		}
+		state.Total = total
+
+		state.Autostash = pathExists(filepath.Join(dir, "rebase-merge", "autostash"))
+
+		if state.HeadName, err = readHeadName(filepath.Join(dir, "rebase-merge", "head-name")); err != nil {
+			return nil, fmt.Errorf("read rebase-merge/head-name: %w", err)
+		}
+
+		if state.Onto, err = readString(filepath.Join(dir, "rebase-merge", "onto")); err != nil {
+			return nil, fmt.Errorf("read rebase-merge/onto: %w", err)
+		}
+
+		if pathExists(filepath.Join(dir, "rebase-merge", "interactive")) {
+			state.State = RebaseInteractive
+
+			if state.Todo, err = readTodo(filepath.Join(dir, "rebase-merge", "git-rebase-todo")); err != nil {
+				return nil, fmt.Errorf("read rebase-merge/git-rebase-todo: %w", err)
+			}
+		} else {
+			state.State = RebaseMerge
+		}
+	case pathExists(filepath.Join(dir, "rebase-apply")):
+		step, err := readInt(filepath.Join(dir, "rebase-apply", "next"))
+		if err != nil {
+			return nil, fmt.Errorf("read rebase-apply/next: %w", err)
+		}
+		state.Step = step
+
+		total, err := readInt(filepath.Join(dir, "rebase-apply", "last"))
+		if err != nil {
+			return nil, fmt.Errorf("read rebase-apply/last: %w", err)
+		}
+		state.Total = total
+
+		state.Autostash = pathExists(filepath.Join(dir, "rebase-apply", "autostash"))
+
+		switch {
+		case pathExists(filepath.Join(dir, "rebase-apply", "rebasing")):
+			state.State = RebaseApply
+
+			if state.HeadName, err = readHeadName(filepath.Join(dir, "rebase-apply", "head-name")); err != nil {
+				return nil, fmt.Errorf("read rebase-apply/head-name: %w", err)
+			}
+
+			if state.Onto, err = readString(filepath.Join(dir, "rebase-apply", "onto")); err != nil {
+				return nil, fmt.Errorf("read rebase-apply/onto: %w", err)
+			}
+		case pathExists(filepath.Join(dir, "rebase-apply", "applying")):
+			state.State = Am
+
+			// Best effort, the message is only written once the patch
+			// has been parsed
+			if message, err := readString(filepath.Join(dir, "rebase-apply", "final-commit")); err == nil {
+				state.Patch, _, _ = strings.Cut(message, "\n")
+			}
+		default:
+			state.State = AmRebase
+		}
+	case pathExists(filepath.Join(dir, "MERGE_HEAD")):
+		state.State = Merging
+
+		// Best effort, the message may have been edited
+		if message, err := readString(filepath.Join(dir, "MERGE_MSG")); err == nil {
+			state.Merge = parseMergeMessage(message)
+		}
+	case pathExists(filepath.Join(dir, "CHERRY_PICK_HEAD")):
+		state.State = CherryPick
+	case pathExists(filepath.Join(dir, "REVERT_HEAD")):
+		state.State = Reverting
+	case pathExists(filepath.Join(dir, "BISECT_LOG")):
+		state.State = Bisecting
+	}
+
+	return state, nil
+}
+
+// gitSequencerProgress retrieves the step and total of a multi-commit
+// cherry-pick or revert, which are zero for a single commit.
+func gitSequencerProgress(path, dir string) (int, int, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "sequencer", "todo"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("read sequencer/todo: %w", err)
+	}
+
+	// The todo list starts with the commit in progress
+	remaining := 0
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			remaining++
+		}
+	}
+
+	head, err := readString(filepath.Join(dir, "sequencer", "head"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("read sequencer/head: %w", err)
+	}
+
+	done, err := runGit(path, "rev-list", "--count", head+"..HEAD")
+	if err != nil {
+		return 0, 0, fmt.Errorf("count sequencer commits: %w", err)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(done))
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: count sequencer commits: %w", ErrParse, err)
+	}
+
+	return n + 1, n + remaining, nil
+}
+
+// gitBisectProgress retrieves the number of good and bad commits marked
+// during a bisect, and the estimated number of steps left, which is zero
+// until both have been marked.
+func gitBisectProgress(path, dir string) (int, int, int, error) {
+	// Terms other than bad and good can be given with --term-new and
+	// --term-old
+	badTerm, goodTerm := "bad", "good"
+	if terms, err := readString(filepath.Join(dir, "BISECT_TERMS")); err == nil {
+		if bad, good, ok := strings.Cut(terms, "\n"); ok {
+			badTerm, goodTerm = bad, strings.TrimSpace(good)
+		}
+	}
+
+	log, err := os.ReadFile(filepath.Join(dir, "BISECT_LOG"))
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("read BISECT_LOG: %w", err)
+	}
+
+	// Every mark is logged as a comment, e.g. "# good: [<hash>] <subject>"
+	good, bad := 0, 0
+	for _, line := range strings.Split(string(log), "\n") {
+		switch {
+		case strings.HasPrefix(line, "# "+goodTerm+": "):
+			good++
+		case strings.HasPrefix(line, "# "+badTerm+": "):
+			bad++
+		}
+	}
+
+	if good == 0 || bad == 0 {
+		return good, bad, 0, nil
+	}
+
+	vars, err := runGit(path, "rev-list", "--bisect-vars", "refs/bisect/"+badTerm, "--not", "--glob=refs/bisect/"+goodTerm+"-*")
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("estimate bisect steps: %w", err)
+	}
+
+	steps := 0
+	for _, line := range strings.Split(vars, "\n") {
+		if value, ok := strings.CutPrefix(line, "bisect_steps="); ok {
+			if steps, err = strconv.Atoi(value); err != nil {
+				return 0, 0, 0, fmt.Errorf("%w: estimate bisect steps: %w", ErrParse, err)
+			}
+		}
+	}
+
+	return good, bad, steps, nil
+}
+
+// pathExists checks if a file or directory exists.
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// stashConflict reports whether the conflicts in the index of the Git
+// directory dir were likely left by applying a stash. There is no operation in
+// progress to tell, so it only checks that the index was written after the
+// latest stash, as git refuses to stash unmerged entries.
+func stashConflict(dir, common string) bool {
+	index, err := os.Stat(filepath.Join(dir, "index"))
+	if err != nil {
+		return false
+	}
+
+	stash, err := os.Stat(filepath.Join(common, "logs", "refs", "stash"))
+	if err != nil {
+		return false
+	}
+
+	return index.ModTime().After(stash.ModTime())
+}
+
+// commonDir retrieves the common Git directory shared by the worktrees of the
+// repository whose Git directory is dir.
+func commonDir(dir string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "commondir"))
+	if errors.Is(err, os.ErrNotExist) {
+		// Only linked worktrees have a commondir
+		return dir, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read commondir: %w", err)
+	}
+
+	common := strings.TrimSpace(string(b))
+	if !filepath.IsAbs(common) {
+		common = filepath.Join(dir, common)
+	}
+
+	return common, nil
+}
+
+// readHeadName reads the branch being rebased from a head-name file, which is
+// empty when rebasing a detached HEAD.
+func readHeadName(path string) (string, error) {
+	name, err := readString(path)
+	if err != nil {
+		return "", err
+	}
+
+	branch, ok := strings.CutPrefix(name, "refs/heads/")
+	if !ok {
+		// Git writes "detached HEAD" in place of a branch
+		return "", nil
+	}
+
+	return branch, nil
+}
+
+// parseMergeMessage parses the name being merged from the first line of a
+// merge message, e.g. "Merge branch 'feature' into main", or returns an empty
+// string.
+func parseMergeMessage(message string) string {
+	line, _, _ := strings.Cut(message, "\n")
+	if !strings.HasPrefix(line, "Merge ") || strings.HasPrefix(line, "Merge commit ") {
+		// Commits are merged by their full hash, which is left to name-rev
+		return ""
+	}
+
+	_, name, _ := strings.Cut(line, "'")
+	name, _, ok := strings.Cut(name, "'")
+	if !ok {
+		return ""
+	}
+
+	return name
+}
+
+// readTodo counts the actions of an interactive rebase todo list by name.
+func readTodo(path string) (map[string]int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// The todo list is gone once the last action is done
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+
+	todo := make(map[string]int)
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		action := fields[0]
+		for _, a := range todoActions {
+			if action == a.abbrev {
+				action = a.name
+			}
+		}
+		todo[action]++
+	}
+
+	return todo, nil
+}
+
+// readString reads a file without surrounding whitespace.
+func readString(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read file: %w", err)
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readInt reads an integer from a file.
+func readInt(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("read file: %w", err)
+	}
+
+	i, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("parse int: %w", err)
+	}
+
+	return i, nil
+}
+
+// gitStatus retrieves the Git repository status.
+func gitStatus(path string, args []string) (string, error) {
+	return runGit(path, args...)
+}
+
+// gitAheadBehind counts the commits HEAD is ahead and behind rev.
+func gitAheadBehind(path, rev string) (int, int, error) {
+	stdout, err := runGit(path, "rev-list", "--left-right", "--count", rev+"...HEAD")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	counts := strings.Fields(stdout)
+	if len(counts) != 2 {
+		return 0, 0, fmt.Errorf("unexpected rev-list output: %q", stdout)
+	}
+
+	behind, err := strconv.Atoi(counts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse behind: %w", err)
+	}
+
+	ahead, err := strconv.Atoi(counts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse ahead: %w", err)
+	}
+
+	return ahead, behind, nil
+}
+
+// gitDiffAgainst counts the files staged relative to rev, and the files
+// modified in the working tree relative to the index.
+func gitDiffAgainst(path, rev string) (int, int, error) {
+	commit, err := gitResolveCommit(path, rev)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cached, err := runGit(path, "diff", "--cached", "--name-status", commit, "--")
+	if err != nil {
+		return 0, 0, fmt.Errorf("diff against %s: %w", rev, err)
+	}
+
+	worktree, err := runGit(path, "diff", "--name-status")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return countLines(cached), countLines(worktree), nil
+}
+
+// gitResolveCommit resolves rev to the commit it names. The revision is never
+// taken for an option, even if it starts with a dash.
+func gitResolveCommit(path, rev string) (string, error) {
+	stdout, err := runGit(path, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("invalid revision %q: %w", rev, err)
+	}
+
+	return strings.TrimSpace(stdout), nil
+}
+
+// countLines counts the non-empty lines in output.
+func countLines(output string) int {
+	n := 0
+	for _, line := range strings.Split(output, "\n") {
+		if line != "" {
+			n++
+		}
+	}
+
+	return n
+}
+
+// gitChurn counts the lines added and removed in the index and working tree.
+func gitChurn(path string) (int, int, error) {
+	added, removed := 0, 0
+
+	for _, args := range [][]string{{"diff", "--numstat"}, {"diff", "--numstat", "--cached"}} {
+		stdout, err := runGit(path, args...)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		a, r, err := parseNumstat(stdout)
+		if err != nil {
+			return 0, 0, err
+		}
+		added += a
+		removed += r
+	}
+
+	return added, removed, nil
+}
+
+// parseNumstat sums the added and removed lines in git diff --numstat output.
+func parseNumstat(output string) (int, int, error) {
+	added, removed := 0, 0
+
+	for _, line := range strings.Split(output, "\n") {
+		s := strings.Fields(line)
+		if len(s) < 3 || s[0] == "-" {
+			// Skip empty lines and binary files
+			continue
+		}
+
+		a, err := strconv.Atoi(s[0])
+		if err != nil {
+			return 0, 0, fmt.Errorf("parse added: %w", err)
+		}
+		added += a
+
+		r, err := strconv.Atoi(s[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("parse removed: %w", err)
+		}
+		removed += r
+	}
+
+	return added, removed, nil
+}
+
+// statusFields are the minimum numbers of fields of each type of line in git
+// status --porcelain=2 output. Paths may contain spaces, adding fields.
+var statusFields = map[string]int{
+	"#": 2,
+	"1": 9,
+	"2": 10,
+	"u": 11,
+	"?": 2,
+	"!": 2,
+}
+
+// parseStatus parses the Git repository status output.
+func parseStatus(output string) (*Status, error) {
+	status := &Status{}
+	hasAB := false
+
+	for _, line := range strings.Split(output, "\n") {
+		s := strings.Split(line, " ")
+		if n, ok := statusFields[s[0]]; ok && len(s) < n {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+
+		switch s[0] {
+		case "#":
+			// Headers are "# <name> <value>", unknown names are skipped as
+			// later versions of git may add them
+			if len(s) < 3 && slices.Contains([]string{"branch.oid", "branch.head", "branch.upstream", "branch.ab", "stash"}, s[1]) {
+				return nil, fmt.Errorf("malformed line %q", line)
+			}
+
+			switch s[1] {
+			case "branch.oid":
+				if s[2] == "(initial)" {
+					// Unborn branch, there is no commit to refer to
+					status.Unborn = true
+				} else {
+					status.Commit = s[2]
+				}
+			case "branch.head":
+				status.Branch = s[2]
+			case "stash":
+				numStashed, err := strconv.Atoi(s[2])
+				if err != nil {
+					return nil, fmt.Errorf("parse num stashed: %w", err)
+				}
+				status.Stashed = numStashed
+			case "branch.upstream":
+				status.Upstream = s[2]
+			case "branch.ab":
+				hasAB = true
+				// Identify ahead and behind by sign rather than position
+				for _, token := range s[2:] {
+					switch {
+					case strings.HasPrefix(token, "+"):
+						ahead, err := strconv.Atoi(token[1:])
+						if err != nil {
+							return nil, fmt.Errorf("parse ahead: %w", err)
+						}
+						status.Ahead = ahead
+					case strings.HasPrefix(token, "-"):
+						behind, err := strconv.Atoi(token[1:])
+						if err != nil {
+							return nil, fmt.Errorf("parse behind: %w", err)
+						}
+						status.Behind = behind
+					}
+				}
+			}
+		case "1", "2":
+			if len(s[1]) != 2 || len(s[2]) != 4 {
+				return nil, fmt.Errorf("malformed line %q", line)
+			}
+
+			// The index (X) and working tree (Y) columns are counted
+			// independently, so a file can be both staged and modified
+			switch s[1][0] {
+			case '.':
+			case 'R', 'C':
+				status.Renamed++
+			case 'D':
+				status.Staged++
+				status.StagedDeleted++
+			default:
+				status.Staged++
+			}
+
+			switch s[1][1] {
+			case 'M', 'T':
+				status.Modified++
+			case 'D':
+				status.Deleted++
+			case 'A':
+				status.IntentToAdd++
+			}
+
+			// Submodules have a S<c><m><u> state, with a dot for each
+			// unchanged part
+			if sub := s[2]; sub[0] == 'S' && sub != "S..." {
+				status.SubmodulesDirty++
+				if sub[2] == 'M' || sub[3] == 'U' {
+					status.submodules = append(status.submodules, parseFile(s).Path)
+				}
+			}
+			status.Files = append(status.Files, parseFile(s))
+		case "u":
+			status.Conflict++
+			switch s[1] {
+			case "DU":
+				status.DeletedByUs++
+			case "UD":
+				status.DeletedByThem++
+			}
+			status.Files = append(status.Files, File{Status: s[1], Path: strings.Join(s[10:], " ")})
+		case "?":
+			status.Untracked++
+			status.Files = append(status.Files, File{Status: "??", Path: strings.Join(s[1:], " ")})
+		case "!":
+			status.Ignored++
+			status.Files = append(status.Files, File{Status: "!!", Path: strings.Join(s[1:], " ")})
+		}
+	}
+
+	status.abMissing = status.Upstream != "" && !hasAB
+
+	return status, nil
+}
+
+// parseFile parses the file of an ordinary or renamed/copied status record.
+func parseFile(s []string) File {
+	if s[0] == "2" {
+		path, origPath, _ := strings.Cut(strings.Join(s[9:], " "), "\t")
+		return File{Status: s[1], Path: path, OrigPath: origPath}
+	}
+
+	return File{Status: s[1], Path: strings.Join(s[8:], " ")}
+}
+
+// buildOutput builds the final output string based on the Git repository status.
+func buildOutput(status Status, state State, flags Flags) string {
+	symbols := flags.Symbols
+
+	if flags.HideClean && !status.Bare && isClean(status, flags) && state.State == "" && status.Ahead == 0 && status.Behind == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(symbols.Prefix)
+
+	if status.Bare {
+		if status.Branch != "" {
+			writeColored(&b, flags.Colors.Branch, shellEscape(status.Branch, flags), flags)
+			b.WriteString(symbols.Sep)
+		}
+		b.WriteString(flags.BareLabel)
+		b.WriteString(symbols.Suffix)
+
+		return b.String()
+	}
+
+	// Detached HEAD during an operation is implied by the state
+	showBranch := !flags.NoBranch && !(flags.HideOpDetached && status.Branch == "(detached)" && state.State != "")
+	if showBranch {
+		writeBranch(&b, status, flags)
+
+		if !isClean(status, flags) {
+			b.WriteString(symbols.Dirty)
+		}
+
+		if status.WorktreeLocked {
+			writeSymbol(&b, symbols.Locked)
+		}
+
+		if status.IndexLocked {
+			writeSymbol(&b, symbols.IndexLock)
+		}
+	}
+
+	stateSep := symbols.StateSep
+	if stateSep == "" {
+		stateSep = symbols.Sep
+	}
+
+	stateAtEnd := flags.StatePosition == StatePositionEnd
+	if state.State != "" && !stateAtEnd {
+		if showBranch {
+			b.WriteString(stateSep)
+		}
+		writeState(&b, state, flags)
+		b.WriteString(stateSep)
+	} else if showBranch {
+		b.WriteString(symbols.Sep)
+	}
+
+	if status.Staged > 0 && !flags.SplitModified {
+		writeCount(&b, flags.Colors.Staged, symbols.Staged, status.Staged, flags)
+
+		if status.StagedDeleted > 0 && symbols.StagedDeleted != "" {
+			writeCount(&b, flags.Colors.Staged, symbols.StagedDeleted, status.StagedDeleted, flags)
+		}
+	}
+	if status.Renamed > 0 {
+		writeCount(&b, flags.Colors.Staged, symbols.Renamed, status.Renamed, flags)
+	}
+	if status.Conflict > 0 {
+		writeCount(&b, flags.Colors.Conflict, symbols.Conflict, status.Conflict, flags)
+
+		if status.DeletedByUs > 0 && symbols.DeletedByUs != "" {
+			writeCount(&b, flags.Colors.Conflict, symbols.DeletedByUs, status.DeletedByUs, flags)
+		}
+		if status.DeletedByThem > 0 && symbols.DeletedByThem != "" {
+			writeCount(&b, flags.Colors.Conflict, symbols.DeletedByThem, status.DeletedByThem, flags)
+		}
+	}
+	if flags.SplitModified {
+		if status.Staged > 0 || status.Modified > 0 {
+			// Staged and unstaged files in a single segment
+			modified := symbols.Modified
+			if !flags.IconsOnly {
+				modified += fmt.Sprintf("%s/%s", formatCount(status.Staged, flags), formatCount(status.Modified, flags))
+			}
+			writeColored(&b, flags.Colors.Modified, modified, flags)
+		}
+	} else if status.Modified > 0 {
+		writeCount(&b, flags.Colors.Modified, symbols.Modified, status.Modified, flags)
+	}
+	if status.Deleted > 0 {
+		writeCount(&b, flags.Colors.Modified, symbols.Deleted, status.Deleted, flags)
+	}
+	if status.SubmodulesDirty > 0 {
+		writeCount(&b, flags.Colors.Modified, symbols.Submodule, status.SubmodulesDirty, flags)
+	}
+	if status.IntentToAdd > 0 {
+		writeCount(&b, flags.Colors.Untracked, symbols.Intent, status.IntentToAdd, flags)
+	}
+	if status.Untracked > 0 {
+		writeCount(&b, flags.Colors.Untracked, symbols.Untracked, status.Untracked, flags)
+	}
+	if status.Ignored > 0 {
+		writeCount(&b, flags.Colors.Untracked, symbols.Ignored, status.Ignored, flags)
+	}
+	if status.Stashed > 0 {
+		writeCount(&b, flags.Colors.Stashed, symbols.Stashed, status.Stashed, flags)
+
+		if status.StashMessage != "" {
+			b.WriteString(fmt.Sprintf("(%s)", shellEscape(truncate(status.StashMessage, int(flags.ShowStashMessage)), flags)))
+		}
+	}
+
+	if status.LinesAdded > 0 || status.LinesRemoved > 0 {
+		b.WriteString(symbols.Sep)
+		b.WriteString(fmt.Sprintf("+%s/-%s", formatNumber(status.LinesAdded, flags), formatNumber(status.LinesRemoved, flags)))
+	}
+
+	if isClean(status, flags) {
+		writeColored(&b, flags.Colors.Clean, symbols.Clean, flags)
+	}
+
+	if state.State != "" && stateAtEnd {
+		b.WriteString(stateSep)
+		writeState(&b, state, flags)
+	}
+
+	if status.Subject != "" {
+		b.WriteString(symbols.Sep)
+		b.WriteString(shellEscape(truncate(status.Subject, int(flags.ShowSubject)), flags))
+	}
+
+	b.WriteString(symbols.Suffix)
+
+	return b.String()
+}
+
+// buildVerbose lists the conflicted, modified and staged files in that order,
+// one per line after the status, with their short status codes.
+func buildVerbose(status Status, flags Flags) string {
+	var conflicted, modified, staged []File
+	for _, file := range status.Files {
+		switch {
+		case len(file.Status) != 2 || file.Status == "??" || file.Status == "!!":
+		case strings.ContainsRune(file.Status, 'U') || file.Status == "AA" || file.Status == "DD":
+			conflicted = append(conflicted, file)
+		case file.Status[1] != '.':
+			modified = append(modified, file)
+		default:
+			staged = append(staged, file)
+		}
+	}
+
+	var b strings.Builder
+	listed := 0
+	for _, group := range []struct {
+		color string
+		files []File
+	}{
+		{flags.Colors.Conflict, conflicted},
+		{flags.Colors.Modified, modified},
+		{flags.Colors.Staged, staged},
+	} {
+		for _, file := range group.files {
+			if listed == flags.VerboseFiles {
+				break
+			}
+			listed++
+
+			// Unchanged columns are spaces in git's short format
+			b.WriteString("\n")
+			writeColored(&b, group.color, strings.ReplaceAll(file.Status, ".", " "), flags)
+			b.WriteString(" " + shellEscape(file.Path, flags))
+			if file.OrigPath != "" {
+				b.WriteString(" <- " + shellEscape(file.OrigPath, flags))
+			}
+		}
+	}
+
+	if more := len(conflicted) + len(modified) + len(staged) - listed; more > 0 {
+		b.WriteString(fmt.Sprintf("\n… and %d more", more))
+	}
+
+	return b.String()
+}
+
+// writeState writes the operation state and its progress, in the state
+// color.
+func writeState(b *strings.Builder, state State, flags Flags) {
+	var s strings.Builder
+	writeStateText(&s, state, flags)
+	writeColored(b, flags.Colors.State, s.String(), flags)
+}
+
+// writeStateText writes the operation state and its progress.
+func writeStateText(b *strings.Builder, state State, flags Flags) {
+	if label, ok := flags.StateLabels[state.State]; ok {
+		b.WriteString(label)
+	} else if flags.CompactState {
+		b.WriteString(compactStates[state.State])
+	} else {
+		b.WriteString(state.State)
+	}
+
+	if state.Merge != "" {
+		b.WriteString(fmt.Sprintf(" %s", shellEscape(state.Merge, flags)))
+	}
+
+	if state.Onto != "" {
+		b.WriteString(fmt.Sprintf(" onto %s", shellEscape(state.Onto, flags)))
+	}
+
+	if state.Total > 0 {
+		b.WriteString(fmt.Sprintf(" %s/%s", formatNumber(state.Step, flags), formatNumber(state.Total, flags)))
+	}
+
+	if state.Patch != "" && flags.PatchLength > 0 {
+		b.WriteString(fmt.Sprintf(" %s", shellEscape(truncate(state.Patch, flags.PatchLength), flags)))
+	}
+
+	if state.BisectGood > 0 || state.BisectBad > 0 {
+		b.WriteString(fmt.Sprintf(" %sg %sb", formatNumber(state.BisectGood, flags), formatNumber(state.BisectBad, flags)))
+		if state.BisectGood > 0 && state.BisectBad > 0 {
+			b.WriteString(fmt.Sprintf(" ~%s", formatNumber(state.BisectSteps, flags)))
+		}
+	}
+
+	if todo := formatTodo(state.Todo); todo != "" && flags.ShowTodo {
+		b.WriteString(fmt.Sprintf(" (%s)", todo))
+	}
+
+	if state.Autostash && flags.ShowAutostash {
+		writeSymbol(b, flags.Symbols.Autostash)
+	}
+}
+
+// formatTodo formats the counts of the remaining interactive rebase actions,
+// e.g. "2 pick, 1 squash".
+func formatTodo(todo map[string]int) string {
+	var counts []string
+	for _, a := range todoActions {
+		if n := todo[a.name]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, a.name))
+		}
+	}
+
+	return strings.Join(counts, ", ")
+}
+
+// writeBranch writes the branch segment, including the upstream and
+// ahead/behind counts.
+func writeBranch(b *strings.Builder, status Status, flags Flags) {
+	symbols := flags.Symbols
+
+	if status.Branch == "(detached)" && !status.Unborn {
+		writeColored(b, flags.Colors.Branch, fmt.Sprintf(":%s", shellEscape(detachedName(status), flags)), flags)
+		return
+	}
+
+	if status.Upstream == "" && flags.LocalPosition == LocalPositionBefore {
+		b.WriteString(symbols.Local + symbols.LocalSep)
+	}
+
+	b.WriteString(symbols.Branch)
+	writeColored(b, flags.Colors.Branch, shellEscape(status.Branch, flags), flags)
+
+	if isProtected(status.Branch, flags.ProtectedBranches) {
+		b.WriteString(symbols.Protected)
+	}
+
+	if flags.ShowHash && !status.Unborn {
+		// Detached HEAD already shows the commit in place of the branch
+		b.WriteString(symbols.Hash)
+		b.WriteString(status.Commit[:max(0, min(flags.HashLength, len(status.Commit)))])
+	}
+
+	if status.Upstream == "" && flags.LocalPosition == LocalPositionAfter {
+		b.WriteString(symbols.LocalSep + symbols.Local)
+	}
+	if status.Upstream != "" && flags.ShowUpstream && !flags.NoUpstream {
+		b.WriteString(fmt.Sprintf(" {%s}", shellEscape(status.Upstream, flags)))
+	}
+
+	if status.Ahead > 0 || status.Behind > 0 {
+		b.WriteString(" ")
+
+		writeAheadBehind(b, status.Ahead, status.Behind, flags)
+
+		if flags.ShowHints {
+			switch {
+			case status.Ahead > 0 && status.Behind > 0:
+				b.WriteString(symbols.SyncHint)
+			case status.Ahead > 0:
+				b.WriteString(symbols.PushHint)
+			default:
+				b.WriteString(symbols.PullHint)
+			}
+		}
+	}
+
+	if status.PushAhead > 0 || status.PushBehind > 0 {
+		b.WriteString(fmt.Sprintf(" %s", symbols.Push))
+		writeAheadBehind(b, status.PushAhead, status.PushBehind, flags)
+	}
+
+	if status.Even {
+		writeSymbol(b, symbols.Even)
+	}
+
+	if status.Tag != "" {
+		b.WriteString(fmt.Sprintf(" %s%s", symbols.Tag, shellEscape(status.Tag, flags)))
+		if status.TagDistance > 0 {
+			b.WriteString("+" + formatCount(status.TagDistance, flags))
+		}
+	}
+
+	if status.CommitTime != 0 {
+		age := time.Since(time.Unix(status.CommitTime, 0))
+
+		color := flags.Colors.Age
+		if flags.StaleAfter > 0 && age > flags.StaleAfter {
+			color = flags.Colors.Stale
+		}
+
+		b.WriteString(" ")
+		writeColored(b, color, formatAge(age), flags)
+	}
+
+	if status.BaseAhead > 0 {
+		b.WriteString(" ")
+		writeCount(b, "", symbols.Base, status.BaseAhead, flags)
+	}
+
+	if status.UpstreamGone {
+		writeSymbol(b, symbols.Gone)
+	}
+
+	if symbol := signatureSymbol(status.Signature, symbols); symbol != "" {
+		b.WriteString(fmt.Sprintf(" %s", symbol))
+	}
+
+	if status.Shallow {
+		writeSymbol(b, symbols.Shallow)
+	}
+
+	if status.SparseIndex && flags.ShowSparseIndex {
+		writeSymbol(b, symbols.SparseIndex)
+	} else if status.Sparse != "" {
+		writeSymbol(b, symbols.Sparse)
+	}
+
+	if status.Promisor {
+		writeSymbol(b, symbols.Promisor)
+	}
+}
+
+// isProtected reports whether branch is in the comma separated list of
+// protected branches, ignoring the spaces around each entry.
+func isProtected(branch, protected string) bool {
+	for _, name := range strings.Split(protected, ",") {
+		if name = strings.TrimSpace(name); name != "" && name == branch {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeSymbol writes symbol after a space, or nothing if it is empty, so
+// blanking a symbol leaves no stray space.
+func writeSymbol(b *strings.Builder, symbol string) {
+	if symbol != "" {
+		b.WriteString(" " + symbol)
+	}
+}
+
+// signatureSymbol returns the symbol for a git log %G? signature status.
+func signatureSymbol(signature string, symbols Symbols) string {
+	switch signature {
+	case "":
+		return ""
+	case "G", "U":
+		// U is a good signature from a key of unknown validity
+		return symbols.Signed
+	case "N":
+		return symbols.Unsigned
+	default:
+		return symbols.BadSignature
+	}
+}
+
+// truncate shortens s to at most n characters, ending it with an ellipsis if
+// it was shortened.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+
+	return string(runes[:max(0, n-1)]) + "…"
+}
+
+// formatAge formats a duration as a short age in its largest whole unit,
+// e.g. 45s, 3h or 2w.
+func formatAge(age time.Duration) string {
+	units := []struct {
+		suffix string
+		length time.Duration
+	}{
+		{"y", 365 * 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+	}
+
+	for _, u := range units {
+		if age >= u.length {
+			return fmt.Sprintf("%d%s", age/u.length, u.suffix)
+		}
+	}
+
+	return fmt.Sprintf("%ds", max(0, age/time.Second))
+}
+
+// detachedName returns the name shown for a detached HEAD.
+func detachedName(status Status) string {
+	if status.Describe != "" {
+		return status.Describe
+	}
+
+	return status.Commit[:7]
+}
+
+// writeAheadBehind writes the non-zero ahead and behind counts in the
+// configured order.
+func writeAheadBehind(b *strings.Builder, ahead, behind int, flags Flags) {
+	counts := []struct {
+		color  string
+		symbol string
+		count  int
+	}{
+		{flags.Colors.Ahead, flags.Symbols.Ahead, ahead},
+		{flags.Colors.Behind, flags.Symbols.Behind, behind},
+	}
+
+	if flags.BehindFirst {
+		slices.Reverse(counts)
+	}
+
+	total := ahead + behind
+	for _, c := range counts {
+		switch {
+		case c.count == 0:
+			continue
+		case flags.ABFraction && !flags.IconsOnly:
+			writeColored(b, c.color, fmt.Sprintf("%s%s/%s", c.symbol, formatCount(c.count, flags), formatCount(total, flags)), flags)
+		default:
+			writeCount(b, c.color, c.symbol, c.count, flags)
+		}
+	}
+}
+
+// writeCount writes a symbol followed by its count.
+func writeCount(b *strings.Builder, color, symbol string, count int, flags Flags) {
+	if !flags.IconsOnly {
+		symbol += formatCount(count, flags)
+	}
+
+	writeColored(b, color, symbol, flags)
+}
+
+// writeColored writes text wrapped in the given color, if any.
+func writeColored(b *strings.Builder, color, text string, flags Flags) {
+	if flags.Output == OutputTmux {
+		if style := tmuxStyle(color); style != "" {
+			b.WriteString("#[" + style + "]" + text + "#[default]")
+		} else {
+			b.WriteString(text)
+		}
+		return
+	}
+
+	// Colors are validated up front, so errors can be ignored here
+	start, _ := ANSIColor(color)
+	if start == "" {
+		b.WriteString(text)
+		return
+	}
+
+	b.WriteString(shellNonPrinting(start, flags))
+	b.WriteString(text)
+	b.WriteString(shellNonPrinting(colorReset, flags))
+}
+
+// formatCount formats a count, capping it at the configured maximum and
+// padding it to the configured width.
+func formatCount(count int, flags Flags) string {
+	formatted := formatNumber(count, flags)
+	if flags.MaxCount > 0 && count > flags.MaxCount {
+		formatted = formatNumber(flags.MaxCount, flags) + "+"
+	}
+
+	// Pad to a fixed number of characters, regardless of their byte length
+	return fmt.Sprintf("%*s", flags.FixedWidth, formatted)
+}
+
+// formatNumber formats a number, grouping its digits if configured.
+func formatNumber(n int, flags Flags) string {
+	digits := strconv.Itoa(n)
+	if !flags.GroupDigits || n < 0 {
+		return digits
+	}
+
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(flags.DigitSep)
+		}
+		b.WriteRune(d)
+	}
+
+	return b.String()
+}
+
+// buildTemplate builds the output by executing the -format template.
+func buildTemplate(status Status, state State, flags Flags) (string, error) {
+	tmpl, err := template.New("format").Parse(flags.Format)
+	if err != nil {
+		return "", fmt.Errorf("parse format: %w", err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, TemplateData{Status: status, State: state, Symbols: flags.Symbols}); err != nil {
+		return "", fmt.Errorf("execute format: %w", err)
+	}
+
+	return b.String(), nil
+}
+
+// buildSummary builds a plain English summary of the Git repository status.
+func buildSummary(status Status, state State, flags Flags) string {
+	var parts []string
+
+	switch {
+	case status.Bare:
+		parts = append(parts, "Bare repository")
+	case status.Branch == "(detached)" && !status.Unborn:
+		parts = append(parts, fmt.Sprintf("Detached at %s", detachedName(status)))
+	default:
+		parts = append(parts, fmt.Sprintf("On %s", status.Branch))
+	}
+
+	if status.UpstreamGone {
+		parts = append(parts, "upstream gone")
+	}
+
+	if state.State != "" {
+		label := state.State
+		if l, ok := flags.StateLabels[state.State]; ok {
+			label = l
+		}
+		if state.Merge != "" {
+			label += " " + state.Merge
+		}
+		if state.Onto != "" {
+			label += " onto " + state.Onto
+		}
+		if state.Total > 0 {
+			label += fmt.Sprintf(" %s/%s", formatNumber(state.Step, flags), formatNumber(state.Total, flags))
+		}
+		if state.Patch != "" && flags.PatchLength > 0 {
+			label += " " + truncate(state.Patch, flags.PatchLength)
+		}
+		if state.BisectGood > 0 || state.BisectBad > 0 {
+			label += fmt.Sprintf(" %s good, %s bad", formatNumber(state.BisectGood, flags), formatNumber(state.BisectBad, flags))
+			if state.BisectGood > 0 && state.BisectBad > 0 {
+				label += fmt.Sprintf(", roughly %s steps left", formatNumber(state.BisectSteps, flags))
+			}
+		}
+
+		parts = append(parts, label)
+	}
+
+	for _, item := range []struct {
+		count            int
+		singular, plural string
+	}{
+		{status.Ahead, "ahead", "ahead"},
+		{status.Behind, "behind", "behind"},
+		{status.Staged, "staged", "staged"},
+		{status.Renamed, "renamed", "renamed"},
+		{status.Conflict, "conflict", "conflicts"},
+		{status.Modified, "modified", "modified"},
+		{status.Deleted, "deleted", "deleted"},
+		{status.SubmodulesDirty, "dirty submodule", "dirty submodules"},
+		{status.IntentToAdd, "intent to add", "intent to add"},
+		{status.Untracked, "untracked", "untracked"},
+		{status.Ignored, "ignored", "ignored"},
+		{status.Stashed, "stash", "stashes"},
+	} {
+		switch {
+		case item.count == 1:
+			parts = append(parts, fmt.Sprintf("1 %s", item.singular))
+		case item.count > 1:
+			parts = append(parts, fmt.Sprintf("%s %s", formatNumber(item.count, flags), item.plural))
+		}
+	}
+
+	if !status.Bare && isClean(status, flags) {
+		parts = append(parts, "clean")
+	}
+
+	return shellEscape(strings.Join(parts, ", "), flags)
+}
+
+// isClean reports whether the working tree should be rendered as clean.
+func isClean(status Status, flags Flags) bool {
+	if status.Staged > 0 || status.Renamed > 0 || status.Conflict > 0 || status.Modified > 0 || status.Deleted > 0 || status.IntentToAdd > 0 {
+		return false
+	}
+
+	if status.Untracked > 0 && !flags.UntrackedIsClean {
+		return false
+	}
+
+	return status.Stashed == 0 || flags.StashIgnoresClean
+}
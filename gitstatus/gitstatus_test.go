@@ -0,0 +1,939 @@
+package gitstatus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Keep the user's git config from affecting the test repositories
+	for key, value := range map[string]string{
+		"GIT_CONFIG_GLOBAL":   os.DevNull,
+		"GIT_CONFIG_NOSYSTEM": "1",
+		"GIT_AUTHOR_NAME":     "Test",
+		"GIT_AUTHOR_EMAIL":    "test@example.com",
+		"GIT_COMMITTER_NAME":  "Test",
+		"GIT_COMMITTER_EMAIL": "test@example.com",
+	} {
+		os.Setenv(key, value)
+	}
+
+	os.Exit(m.Run())
+}
+
+// testFlags returns flags with short ASCII symbols.
+func testFlags() Flags {
+	return Flags{
+		Color:         ColorNever,
+		Backend:       BackendGit,
+		StatePosition: StatePositionAfterBranch,
+		LocalPosition: LocalPositionAfter,
+		Symbols: Symbols{
+			Prefix:    "[",
+			Suffix:    "]",
+			Sep:       "|",
+			Local:     "L",
+			LocalSep:  " ",
+			Ahead:     "^",
+			Behind:    "v",
+			Staged:    "S",
+			Renamed:   "R",
+			Conflict:  "X",
+			Modified:  "M",
+			Deleted:   "D",
+			Intent:    "I",
+			Untracked: "?",
+			Stashed:   "$",
+			Clean:     "ok",
+			Nop:       " ",
+		},
+	}
+}
+
+// runTestGit runs git in dir, failing the test on errors.
+func runTestGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	stdout, err := runGit(dir, args...)
+	if err != nil {
+		t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+	}
+
+	return stdout
+}
+
+// writeFile writes a file in dir, failing the test on errors.
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testRepo creates a repository with a single commit on main.
+func testRepo(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	dir := t.TempDir()
+	runTestGit(t, dir, "init", "-q", "-b", "main")
+	writeFile(t, dir, "file", "one\n")
+	runTestGit(t, dir, "add", "file")
+	runTestGit(t, dir, "commit", "-q", "-m", "initial")
+
+	return dir
+}
+
+// stubGit puts a git script first in PATH for the rest of the test. Its
+// arguments are matched against the patterns of the case statement in cases,
+// surrounded by spaces, and run the real git if no pattern matches.
+func stubGit(t *testing.T, cases string) {
+	t.Helper()
+
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found")
+	}
+
+	dir := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\ncase \" $* \" in\n%s\nesac\nexec %q \"$@\"\n", cases, realGit)
+	if err := os.WriteFile(filepath.Join(dir, "git"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRenderConcurrent(t *testing.T) {
+	// Each repository has as many untracked files as its index
+	var repos []string
+	for i := range 8 {
+		dir := testRepo(t)
+		for j := range i {
+			writeFile(t, dir, fmt.Sprintf("untracked%d", j), "")
+		}
+		repos = append(repos, dir)
+	}
+
+	for _, backend := range []string{BackendGit, BackendNative} {
+		t.Run(backend, func(t *testing.T) {
+			flags := testFlags()
+			flags.Backend = backend
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 20*len(repos))
+			for n := range 20 * len(repos) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					i := n % len(repos)
+					want := fmt.Sprintf("[main L|?%d]", i)
+					if i == 0 {
+						want = "[main L|ok]"
+					}
+
+					got, err := Render(repos[i], flags)
+					if err != nil {
+						errs <- err
+					} else if got != want {
+						errs <- fmt.Errorf("Render(%s) = %q, want %q", repos[i], got, want)
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestZeroFlags(t *testing.T) {
+	dir := testRepo(t)
+
+	want, err := Render(dir, testFlags())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty modes stand for their defaults, and stdout is not a terminal
+	got, err := Render(dir, Flags{Symbols: testFlags().Symbols})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Render() with empty modes = %q, want %q", got, want)
+	}
+}
+
+func TestRevisionOptions(t *testing.T) {
+	dir := testRepo(t)
+	runTestGit(t, dir, "tag", "v1")
+	writeFile(t, dir, "file", "two\n")
+	runTestGit(t, dir, "commit", "-q", "-am", "second")
+	writeFile(t, dir, "new", "")
+	runTestGit(t, dir, "add", "new")
+
+	pwned := filepath.Join(t.TempDir(), "pwned")
+
+	tests := []struct {
+		name    string
+		flags   func(*Flags)
+		want    string
+		wantErr bool
+	}{
+		{"against tag", func(f *Flags) { f.Against = "v1" }, "[main L|S2]", false},
+		{"against unknown", func(f *Flags) { f.Against = "nope" }, "", true},
+		{"against option", func(f *Flags) { f.Against = "--output=" + pwned }, "", true},
+		{"base tag", func(f *Flags) { f.ShowBase, f.Base = true, "v1" }, "[main L Δ1|S1]", false},
+		{"base option", func(f *Flags) { f.ShowBase, f.Base = true, "--output="+pwned }, "[main L|S1]", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := testFlags()
+			flags.Symbols.Base = "Δ"
+			tt.flags(&flags)
+
+			got, err := Render(dir, flags)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("Render() = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+			if _, err := os.Stat(pwned); err == nil {
+				t.Errorf("revision was taken for an option, %s was written", pwned)
+			}
+		})
+	}
+}
+
+func TestBuildOutput(t *testing.T) {
+	onMain := Status{Branch: "main"}
+	detached := Status{Branch: "(detached)", Commit: "1234abcd5678"}
+	dirty := Status{Branch: "main", Upstream: "origin/main", Ahead: 2, Behind: 1, Staged: 3, Modified: 12, Untracked: 1}
+	flagged := Status{Branch: "main", Upstream: "origin/main", Even: true, UpstreamGone: true, WorktreeLocked: true, IndexLocked: true, Shallow: true, Sparse: "cone", Promisor: true}
+
+	protected := func(f *Flags) {
+		f.ProtectedBranches = "main,master"
+		f.Symbols.Protected = "!"
+	}
+	fraction := func(f *Flags) { f.ABFraction = true }
+	hash := func(f *Flags) {
+		f.ShowHash, f.HashLength = true, 8
+		f.Symbols.Hash = "@"
+	}
+	hints := func(f *Flags) {
+		f.ShowHints = true
+		f.Symbols.PushHint, f.Symbols.PullHint, f.Symbols.SyncHint = ">", "<", "<>"
+	}
+
+	tests := []struct {
+		name   string
+		status Status
+		state  State
+		flags  func(*Flags)
+		want   string
+	}{
+		{"clean", onMain, State{}, nil, "[main L|ok]"},
+		{"stash not clean", Status{Branch: "main", Stashed: 1}, State{}, nil, "[main L|$1]"},
+		{"stash ignores clean", Status{Branch: "main", Stashed: 1}, State{}, func(f *Flags) { f.StashIgnoresClean = true }, "[main L|$1ok]"},
+		{"counts", dirty, State{}, nil, "[main ^2v1|S3M12?1]"},
+		{"icons only", dirty, State{}, func(f *Flags) { f.IconsOnly = true }, "[main ^v|SM?]"},
+		{"state", onMain, State{State: Merging}, nil, "[main L|MERGING|ok]"},
+		{"state sep", onMain, State{State: Merging}, func(f *Flags) { f.Symbols.StateSep = " " }, "[main L MERGING ok]"},
+		{"hints ahead", Status{Branch: "main", Upstream: "origin/main", Ahead: 2}, State{}, hints, "[main ^2>|ok]"},
+		{"hints behind", Status{Branch: "main", Upstream: "origin/main", Behind: 1}, State{}, hints, "[main v1<|ok]"},
+		{"hints diverged", Status{Branch: "main", Upstream: "origin/main", Ahead: 2, Behind: 1}, State{}, hints, "[main ^2v1<>|ok]"},
+		{"below max count", Status{Branch: "main", Modified: 98}, State{}, func(f *Flags) { f.MaxCount = 99 }, "[main L|M98]"},
+		{"at max count", Status{Branch: "main", Modified: 99}, State{}, func(f *Flags) { f.MaxCount = 99 }, "[main L|M99]"},
+		{"above max count", Status{Branch: "main", Modified: 2381, Untracked: 100}, State{}, func(f *Flags) { f.MaxCount = 99 }, "[main L|M99+?99+]"},
+		{"colors", Status{Branch: "main", Modified: 1}, State{}, func(f *Flags) { f.Colors.Branch, f.Colors.Modified = "yellow", "bold red" }, "[\x1b[33mmain\x1b[0m L|\x1b[1;31mM1\x1b[0m]"},
+		{"ahead first", Status{Branch: "main", Upstream: "origin/main", Ahead: 2, Behind: 3}, State{}, nil, "[main ^2v3|ok]"},
+		{"behind first", Status{Branch: "main", Upstream: "origin/main", Ahead: 2, Behind: 3}, State{}, func(f *Flags) { f.BehindFirst = true }, "[main v3^2|ok]"},
+		{"detached", detached, State{}, nil, "[:1234abc|ok]"},
+		{"detached hide op detached", detached, State{}, func(f *Flags) { f.HideOpDetached = true }, "[:1234abc|ok]"},
+		{"rebase detached", detached, State{State: RebaseMerge}, nil, "[:1234abc|REBASE-m|ok]"},
+		{"rebase hide op detached", detached, State{State: RebaseMerge}, func(f *Flags) { f.HideOpDetached = true }, "[REBASE-m|ok]"},
+		{"digits", Status{Branch: "main", Modified: 1234}, State{}, nil, "[main L|M1234]"},
+		{"group digits", Status{Branch: "main", Modified: 1234, Untracked: 12}, State{}, func(f *Flags) { f.GroupDigits, f.DigitSep = true, "," }, "[main L|M1,234?12]"},
+		{"staged and modified", Status{Branch: "main", Staged: 3, Modified: 2}, State{}, nil, "[main L|S3M2]"},
+		{"split modified", Status{Branch: "main", Staged: 3, Modified: 2}, State{}, func(f *Flags) { f.SplitModified = true }, "[main L|M3/2]"},
+		{"split modified staged", Status{Branch: "main", Staged: 3}, State{}, func(f *Flags) { f.SplitModified = true }, "[main L|M3/0]"},
+		{"split modified unstaged", Status{Branch: "main", Modified: 2}, State{}, func(f *Flags) { f.SplitModified = true }, "[main L|M0/2]"},
+		{"no branch", dirty, State{}, func(f *Flags) { f.NoBranch = true }, "[S3M12?1]"},
+		{"no branch state", dirty, State{State: Merging}, func(f *Flags) { f.NoBranch = true }, "[MERGING|S3M12?1]"},
+		{"hide clean", onMain, State{}, func(f *Flags) { f.HideClean = true }, ""},
+		{"hide clean dirty", Status{Branch: "main", Modified: 1}, State{}, func(f *Flags) { f.HideClean = true }, "[main L|M1]"},
+		{"hide clean state", onMain, State{State: Merging}, func(f *Flags) { f.HideClean = true }, "[main L|MERGING|ok]"},
+		{"hide clean diverged", Status{Branch: "main", Upstream: "origin/main", Behind: 1}, State{}, func(f *Flags) { f.HideClean = true }, "[main v1|ok]"},
+		{"protected", onMain, State{}, protected, "[main! L|ok]"},
+		{"not protected", Status{Branch: "topic"}, State{}, protected, "[topic L|ok]"},
+		{"protected with spaces", Status{Branch: "release"}, State{}, func(f *Flags) {
+			f.ProtectedBranches = "main, release "
+			f.Symbols.Protected = "!"
+		}, "[release! L|ok]"},
+		{"state after branch", Status{Branch: "main", Modified: 1}, State{State: RebaseInteractive, Step: 1, Total: 3}, nil, "[main L|REBASE-i 1/3|M1]"},
+		{"state at end", Status{Branch: "main", Modified: 1}, State{State: RebaseInteractive, Step: 1, Total: 3}, func(f *Flags) { f.StatePosition = StatePositionEnd }, "[main L|M1|REBASE-i 1/3]"},
+		{"staged deleted", Status{Branch: "main", Staged: 2, StagedDeleted: 1}, State{}, nil, "[main L|S2]"},
+		{"staged deleted symbol", Status{Branch: "main", Staged: 2, StagedDeleted: 1}, State{}, func(f *Flags) { f.Symbols.StagedDeleted = "-" }, "[main L|S2-1]"},
+		{"fraction ahead", Status{Branch: "main", Upstream: "origin/main", Ahead: 2}, State{}, fraction, "[main ^2/2|ok]"},
+		{"fraction behind", Status{Branch: "main", Upstream: "origin/main", Behind: 3}, State{}, fraction, "[main v3/3|ok]"},
+		{"fraction diverged", Status{Branch: "main", Upstream: "origin/main", Ahead: 2, Behind: 3}, State{}, fraction, "[main ^2/5v3/5|ok]"},
+		{"untracked not clean", Status{Branch: "main", Untracked: 2}, State{}, nil, "[main L|?2]"},
+		{"untracked is clean", Status{Branch: "main", Untracked: 2}, State{}, func(f *Flags) { f.UntrackedIsClean = true }, "[main L|?2ok]"},
+		{"deleted conflicts", Status{Branch: "main", Conflict: 3, DeletedByUs: 1, DeletedByThem: 1}, State{}, func(f *Flags) { f.Symbols.DeletedByUs, f.Symbols.DeletedByThem = "U", "T" }, "[main L|X3U1T1]"},
+		{"show hash", Status{Branch: "main", Commit: "1234abcd5678"}, State{}, hash, "[main@1234abcd L|ok]"},
+		{"show hash unborn", Status{Branch: "main", Unborn: true}, State{}, hash, "[main L|ok]"},
+		{"fixed width", Status{Branch: "main", Modified: 3, Untracked: 12}, State{}, func(f *Flags) { f.FixedWidth = 3 }, "[main L|M  3? 12]"},
+		{"fixed width unicode", Status{Branch: "main", Modified: 3, Untracked: 12}, State{}, func(f *Flags) { f.FixedWidth, f.Symbols.Modified = 3, "✚" }, "[main L|✚  3? 12]"},
+		{"fixed width overflow", Status{Branch: "main", Modified: 1234}, State{}, func(f *Flags) { f.FixedWidth = 3 }, "[main L|M1234]"},
+		{"local after", onMain, State{}, nil, "[main L|ok]"},
+		{"local before", onMain, State{}, func(f *Flags) { f.LocalPosition = LocalPositionBefore }, "[L main|ok]"},
+		{"local none", onMain, State{}, func(f *Flags) { f.LocalPosition = LocalPositionNone }, "[main|ok]"},
+		{"local adjacent", onMain, State{}, func(f *Flags) { f.Symbols.LocalSep = "" }, "[mainL|ok]"},
+		{"local with upstream", Status{Branch: "main", Upstream: "origin/main"}, State{}, nil, "[main|ok]"},
+		{"dirty marker clean", onMain, State{}, func(f *Flags) { f.Symbols.Dirty = "*" }, "[main L|ok]"},
+		{"dirty marker", dirty, State{}, func(f *Flags) { f.Symbols.Dirty = "*" }, "[main ^2v1*|S3M12?1]"},
+		{"blank symbols", flagged, State{}, nil, "[main|ok]"},
+		{"flag symbols", flagged, State{}, func(f *Flags) {
+			f.Symbols.Locked, f.Symbols.IndexLock, f.Symbols.Even, f.Symbols.Gone = "#", "&", "=", "gone"
+			f.Symbols.Shallow, f.Symbols.Sparse, f.Symbols.Promisor = "~", "%", "p"
+		}, "[main = gone ~ % p # &|ok]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := testFlags()
+			if tt.flags != nil {
+				tt.flags(&flags)
+			}
+
+			if got := buildOutput(tt.status, tt.state, flags); got != tt.want {
+				t.Errorf("buildOutput() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   Status
+	}{
+		{"initial", "# branch.oid (initial)\n# branch.head main", Status{Unborn: true, Branch: "main"}},
+		{"commit", "# branch.oid 1234abcd\n# branch.head main", Status{Commit: "1234abcd", Branch: "main"}},
+		{"files", "1 .M N... 100644 100644 100644 abc abc dir/a file\n2 R. N... 100644 100644 100644 abc abc R100 new\told\n? un tracked", Status{
+			Modified:  1,
+			Renamed:   1,
+			Untracked: 1,
+			Files: []File{
+				{Status: ".M", Path: "dir/a file"},
+				{Status: "R.", Path: "new", OrigPath: "old"},
+				{Status: "??", Path: "un tracked"},
+			},
+		}},
+		{"ahead behind", "# branch.upstream origin/main\n# branch.ab +2 -3", Status{Upstream: "origin/main", Ahead: 2, Behind: 3}},
+		{"behind ahead", "# branch.upstream origin/main\n# branch.ab -3 +2", Status{Upstream: "origin/main", Ahead: 2, Behind: 3}},
+		{"ahead behind zero", "# branch.upstream origin/main\n# branch.ab +0 -0", Status{Upstream: "origin/main"}},
+		{"ahead behind missing", "# branch.upstream origin/main", Status{Upstream: "origin/main", abMissing: true}},
+		{"staged deleted", "1 D. N... 100644 000000 000000 abc 000 gone\n1 M. N... 100644 100644 100644 abc def kept", Status{
+			Staged:        2,
+			StagedDeleted: 1,
+			Files:         []File{{Status: "D.", Path: "gone"}, {Status: "M.", Path: "kept"}},
+		}},
+		{"deleted by us", "u DU N... 100644 000000 100644 100644 abc 000 def file", Status{
+			Conflict:    1,
+			DeletedByUs: 1,
+			Files:       []File{{Status: "DU", Path: "file"}},
+		}},
+		{"deleted by them", "u UD N... 100644 100644 000000 100644 abc def 000 file", Status{
+			Conflict:      1,
+			DeletedByThem: 1,
+			Files:         []File{{Status: "UD", Path: "file"}},
+		}},
+		{"content conflict", "u UU N... 100644 100644 100644 100644 abc def ghi file", Status{
+			Conflict: 1,
+			Files:    []File{{Status: "UU", Path: "file"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStatus(tt.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseStatus() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitAheadBehind(t *testing.T) {
+	tests := []struct {
+		name                  string
+		revList               string
+		wantAhead, wantBehind int
+		wantErr               bool
+	}{
+		{"counted", `*" rev-list "*) printf '2\t3\n'; exit 0 ;;`, 3, 2, false},
+		{"failed", `*" rev-list "*) exit 128 ;;`, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubGit(t, tt.revList)
+
+			ahead, behind, err := gitAheadBehind(t.TempDir(), "@{u}")
+			if ahead != tt.wantAhead || behind != tt.wantBehind || (err != nil) != tt.wantErr {
+				t.Errorf("gitAheadBehind() = %d, %d, %v, want %d, %d, error %t", ahead, behind, err, tt.wantAhead, tt.wantBehind, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestChurn(t *testing.T) {
+	dir := testRepo(t)
+	writeFile(t, dir, "file", "two\n")
+	stubGit(t, `*" diff --numstat --cached "*) printf '3\t1\tstaged\n'; exit 0 ;;
+*" diff --numstat "*) printf '10\t2\tfile\n-\t-\tbinary\n'; exit 0 ;;`)
+
+	flags := testFlags()
+	flags.Churn = true
+	got, err := Render(dir, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[main L|M1|+13/-3]"; got != want {
+		t.Errorf("Render() = %q, want %q", got, want)
+	}
+}
+
+func TestAutostash(t *testing.T) {
+	dir := testRepo(t)
+	runTestGit(t, dir, "checkout", "-q", "-b", "topic")
+	writeFile(t, dir, "file", "topic\n")
+	runTestGit(t, dir, "commit", "-q", "-am", "topic")
+	runTestGit(t, dir, "checkout", "-q", "main")
+	writeFile(t, dir, "file", "main\n")
+	runTestGit(t, dir, "commit", "-q", "-am", "main")
+	runTestGit(t, dir, "checkout", "-q", "topic")
+	writeFile(t, dir, "other", "")
+	runTestGit(t, dir, "add", "other")
+
+	// Stop the rebase at a conflict, with the staged file autostashed
+	if _, err := runGit(dir, "rebase", "--merge", "--autostash", "main"); err == nil {
+		t.Fatal("rebase succeeded, want conflict")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git", "rebase-merge", "autostash")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		showAutostash bool
+		want          string
+	}{
+		{false, "[topic L|REBASE-i onto main 1/1|X1]"},
+		{true, "[topic L|REBASE-i onto main 1/1 +stash|X1]"},
+	} {
+		flags := testFlags()
+		flags.ShowAutostash = tt.showAutostash
+		flags.Symbols.Autostash = "+stash"
+		got, err := Render(dir, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Render() with -show-autostash=%t = %q, want %q", tt.showAutostash, got, tt.want)
+		}
+	}
+}
+
+func TestCheckEven(t *testing.T) {
+	dir := testRepo(t)
+	runTestGit(t, dir, "checkout", "-q", "-b", "topic", "--track", "main")
+
+	flags := testFlags()
+	flags.CheckEven = true
+	flags.Symbols.Even = "="
+
+	for _, tt := range []struct {
+		name, want string
+		setup      func()
+	}{
+		{"equal", "[topic =|ok]", func() {}},
+		{"unequal", "[topic ^1|ok]", func() { runTestGit(t, dir, "commit", "-q", "--allow-empty", "-m", "topic") }},
+	} {
+		tt.setup()
+
+		got, err := Render(dir, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Render() with %s OIDs = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJSONState(t *testing.T) {
+	dir := testRepo(t)
+
+	flags := testFlags()
+	flags.JSON = true
+
+	// state renders the JSON output, decoding the state fields
+	state := func() map[string]any {
+		t.Helper()
+
+		output, err := Render(dir, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(output), &fields); err != nil {
+			t.Fatal(err)
+		}
+		return map[string]any{"state": fields["state"], "state_step": fields["state_step"], "state_total": fields["state_total"]}
+	}
+
+	if got, want := state(), map[string]any{"state": "", "state_step": 0.0, "state_total": 0.0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("state fields = %v, want %v", got, want)
+	}
+
+	runTestGit(t, dir, "checkout", "-q", "-b", "topic")
+	for _, content := range []string{"topic\n", "topic two\n"} {
+		writeFile(t, dir, "file", content)
+		runTestGit(t, dir, "commit", "-q", "-am", content)
+	}
+	runTestGit(t, dir, "checkout", "-q", "main")
+	writeFile(t, dir, "file", "main\n")
+	runTestGit(t, dir, "commit", "-q", "-am", "main")
+	if _, err := runGit(dir, "cherry-pick", "main..topic"); err == nil {
+		t.Fatal("cherry-pick succeeded, want conflict")
+	}
+
+	if got, want := state(), map[string]any{"state": CherryPick, "state_step": 1.0, "state_total": 2.0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("state fields during cherry-pick = %v, want %v", got, want)
+	}
+}
+
+func TestNotInRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	// Don't find a repository the temporary directory may be in
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(dir))
+
+	for _, tt := range []struct {
+		emptyBrackets bool
+		want          string
+	}{
+		{false, " "},
+		{true, "[]"},
+	} {
+		flags := testFlags()
+		flags.EmptyBrackets = tt.emptyBrackets
+		got, err := Render(dir, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Render() with -empty-brackets=%t = %q, want %q", tt.emptyBrackets, got, tt.want)
+		}
+	}
+}
+
+func TestLookupRepo(t *testing.T) {
+	dir := testRepo(t)
+	other := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, dir, "config", "compactstatus.symbol-Modified", "m")
+	// Don't find a repository the temporary directories may be in
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(other))
+
+	for _, tt := range []struct {
+		name string
+		path string
+		env  map[string]string
+		want Repo
+	}{
+		{"subdirectory", sub, nil, Repo{Dir: filepath.Join(dir, ".git"), TopLevel: dir}},
+		{"inside .git", filepath.Join(dir, ".git"), nil, Repo{Dir: filepath.Join(dir, ".git")}},
+		{"not in repo", other, nil, Repo{}},
+		{"ceiling", sub, map[string]string{"GIT_CEILING_DIRECTORIES": dir}, Repo{}},
+		{"git dir", other, map[string]string{"GIT_DIR": filepath.Join(dir, ".git")}, Repo{Dir: filepath.Join(dir, ".git"), TopLevel: other}},
+		{"work tree", other, map[string]string{"GIT_DIR": filepath.Join(dir, ".git"), "GIT_WORK_TREE": dir}, Repo{Dir: filepath.Join(dir, ".git"), TopLevel: dir}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			got, err := LookupRepo(tt.path, "compactstatus")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The parsed git config is only kept for reuse
+			got.gitConfig = nil
+			tt.want.Path = tt.path
+			if tt.want.Dir != "" {
+				tt.want.Config = map[string]string{"symbol-modified": "m"}
+			} else {
+				tt.want.Config = map[string]string{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LookupRepo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorktreeLocked(t *testing.T) {
+	dir := testRepo(t)
+	worktree := filepath.Join(t.TempDir(), "worktree")
+	runTestGit(t, dir, "worktree", "add", "-q", "-b", "topic", worktree)
+
+	flags := testFlags()
+	flags.Symbols.Locked = "locked"
+
+	for _, tt := range []struct {
+		locked bool
+		want   string
+	}{
+		{false, "[topic L|ok]"},
+		{true, "[topic L locked|ok]"},
+	} {
+		if tt.locked {
+			runTestGit(t, dir, "worktree", "lock", worktree)
+		}
+
+		got, err := Render(worktree, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Render() in a worktree with locked=%t = %q, want %q", tt.locked, got, tt.want)
+		}
+	}
+
+	// The main worktree has no lock of its own
+	if got, err := Render(dir, flags); err != nil || got != "[main L|ok]" {
+		t.Errorf("Render() in the main worktree = %q, %v, want %q", got, err, "[main L|ok]")
+	}
+}
+
+func TestParseStatusMalformed(t *testing.T) {
+	for _, output := range []string{
+		"#",
+		"# branch.oid",
+		"# stash many",
+		"1 M",
+		"1 M N... 100644 100644 100644 abc def file",
+		"2 R. S",
+		"u UU N...",
+	} {
+		if _, err := parseStatus(output); err == nil {
+			t.Errorf("parseStatus(%q) succeeded, want error", output)
+		}
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	dir := testRepo(t)
+
+	tests := []struct {
+		name      string
+		cases     string
+		wantParse bool
+	}{
+		{"malformed status", `*" status "*) echo "1 M"; exit 0 ;;`, true},
+		{"git failure", `*" status "*) echo "fatal: broken" >&2; exit 128 ;;`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubGit(t, tt.cases)
+
+			_, err := Render(dir, testFlags())
+			var exitErr *exec.ExitError
+			switch {
+			case err == nil:
+				t.Fatal("Render() succeeded, want error")
+			case tt.wantParse && !errors.Is(err, ErrParse):
+				t.Errorf("Render() = %v, want ErrParse", err)
+			case !tt.wantParse && (errors.Is(err, ErrParse) || !errors.As(err, &exitErr)):
+				t.Errorf("Render() = %v, want git exit error", err)
+			}
+		})
+	}
+}
+
+func TestStashFallback(t *testing.T) {
+	dir := testRepo(t)
+	// Like older git, which ignores --show-stash
+	stubGit(t, `*" status "*) printf '# branch.oid 1234abcd\n# branch.head main\n'; exit 0 ;;
+*" stash list "*) printf 'stash@{0}: WIP on main: one\nstash@{1}: WIP on main: two\n'; exit 0 ;;`)
+
+	for _, tt := range []struct {
+		stashFallback bool
+		want          string
+	}{
+		{false, "[main L|ok]"},
+		{true, "[main L|$2]"},
+	} {
+		flags := testFlags()
+		flags.StashFallback = tt.stashFallback
+		got, err := Render(dir, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Render() with -stash-fallback=%t = %q, want %q", tt.stashFallback, got, tt.want)
+		}
+	}
+}
+
+func TestCompactState(t *testing.T) {
+	tests := []struct{ state, want string }{
+		{RebaseApply, "RB"},
+		{RebaseMerge, "RB-m"},
+		{RebaseInteractive, "RB-i"},
+		{Am, "AM"},
+		{AmRebase, "AM/RB"},
+		{Merging, "MG"},
+		{CherryPick, "CP"},
+		{Reverting, "RV"},
+		{Bisecting, "BS"},
+		{StashConflict, "SC"},
+	}
+
+	flags := testFlags()
+	flags.CompactState = true
+	for _, tt := range tests {
+		want := "[main L|" + tt.want + "|ok]"
+		if got := buildOutput(Status{Branch: "main"}, State{State: tt.state}, flags); got != want {
+			t.Errorf("buildOutput() with state %s = %q, want %q", tt.state, got, want)
+		}
+	}
+}
+
+func TestIncludeRaw(t *testing.T) {
+	dir := testRepo(t)
+	raw := "# branch.oid 1234abcd\n# branch.head main\n? new file\n"
+	stubGit(t, fmt.Sprintf(`*" status "*) printf %q; exit 0 ;;`, raw))
+
+	for _, includeRaw := range []bool{false, true} {
+		flags := testFlags()
+		flags.JSON = true
+		flags.IncludeRaw = includeRaw
+		output, err := Render(dir, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var fields struct {
+			Raw *string `json:"raw"`
+		}
+		if err := json.Unmarshal([]byte(output), &fields); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case !includeRaw && fields.Raw != nil:
+			t.Errorf("raw = %q without -include-raw, want no field", *fields.Raw)
+		case includeRaw && (fields.Raw == nil || *fields.Raw != raw):
+			t.Errorf("raw = %v, want %q", fields.Raw, raw)
+		}
+	}
+}
+
+func TestSuperproject(t *testing.T) {
+	sub := testRepo(t)
+	runTestGit(t, sub, "checkout", "-q", "-b", "sub")
+
+	dir := testRepo(t)
+	runTestGit(t, dir, "-c", "protocol.file.allow=always", "submodule", "add", "-q", sub, "sub")
+	runTestGit(t, dir, "commit", "-q", "-m", "add submodule")
+
+	for _, tt := range []struct {
+		superproject bool
+		want         string
+	}{
+		{false, "[sub|ok]"},
+		{true, "[main L|ok]"},
+	} {
+		flags := testFlags()
+		flags.Superproject = tt.superproject
+		got, err := Render(filepath.Join(dir, "sub"), flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Render() in a submodule with -superproject=%t = %q, want %q", tt.superproject, got, tt.want)
+		}
+	}
+}
+
+func TestBare(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "bare.git")
+	runTestGit(t, testRepo(t), "clone", "-q", "--bare", ".", dir)
+
+	for _, backend := range []string{BackendGit, BackendNative} {
+		flags := testFlags()
+		flags.Backend = backend
+		flags.BareLabel = "BARE"
+		got, err := Render(dir, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "[main|BARE]"; got != want {
+			t.Errorf("Render() with the %s backend = %q, want %q", backend, got, want)
+		}
+	}
+}
+
+func TestInGitDir(t *testing.T) {
+	dir := filepath.Join(testRepo(t), ".git")
+
+	for _, backend := range []string{BackendGit, BackendNative} {
+		for _, tt := range []struct {
+			json bool
+			want string
+		}{
+			{false, " "},
+			{true, "null"},
+		} {
+			flags := testFlags()
+			flags.Backend = backend
+			flags.JSON = tt.json
+			got, err := Render(dir, flags)
+			if err != nil {
+				t.Fatalf("Render() with the %s backend: %v", backend, err)
+			}
+			if got != tt.want {
+				t.Errorf("Render() in .git with the %s backend and -json=%t = %q, want %q", backend, tt.json, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestQuoteJSONNumbers(t *testing.T) {
+	b, err := json.Marshal(Output{Status: Status{Branch: "main", Ahead: 2, Bare: true}, State: State{State: RebaseMerge, Step: 1, Total: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quoted, err := quoteJSONNumbers(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{`"ahead":"2"`, `"behind":"0"`, `"state_total":"3"`, `"branch":"main"`, `"bare":true`} {
+		if !strings.Contains(string(quoted), want) {
+			t.Errorf("quoteJSONNumbers() = %s, want %s in it", quoted, want)
+		}
+	}
+}
+
+func TestStashConflict(t *testing.T) {
+	// conflictRepo leaves a conflict from popping a stash
+	conflictRepo := func(t *testing.T) string {
+		dir := testRepo(t)
+		writeFile(t, dir, "file", "stashed\n")
+		runTestGit(t, dir, "stash", "-q")
+		writeFile(t, dir, "file", "committed\n")
+		runTestGit(t, dir, "commit", "-q", "-am", "second")
+		if _, err := runGit(dir, "stash", "pop", "-q"); err == nil {
+			t.Fatal("stash pop succeeded, want conflict")
+		}
+		return dir
+	}
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T) string
+		want  string
+	}{
+		{"stash popped", conflictRepo, "[main L|STASH-CONFLICT|X1$1]"},
+		{"stashed after the conflict", func(t *testing.T) string {
+			dir := conflictRepo(t)
+			// Like a stash made after the conflicts, which git refuses
+			future := time.Now().Add(time.Minute)
+			if err := os.Chtimes(filepath.Join(dir, ".git", "logs", "refs", "stash"), future, future); err != nil {
+				t.Fatal(err)
+			}
+			return dir
+		}, "[main L|X1$1]"},
+		{"no stash", func(t *testing.T) string {
+			dir := conflictRepo(t)
+			runTestGit(t, dir, "stash", "drop", "-q")
+			return dir
+		}, "[main L|X1]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tt.setup(t)
+
+			flags := testFlags()
+			flags.ShowStashConflict = true
+			got, err := Render(dir, flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildSummary(t *testing.T) {
+	groupDigits := func(f *Flags) { f.GroupDigits, f.DigitSep = true, "," }
+
+	tests := []struct {
+		name   string
+		status Status
+		state  State
+		flags  func(*Flags)
+		want   string
+	}{
+		{"clean", Status{Branch: "main"}, State{}, nil, "On main, clean"},
+		{"mixed", Status{Branch: "main", Upstream: "origin/main", Ahead: 2, Modified: 3, Untracked: 1}, State{}, nil, "On main, 2 ahead, 3 modified, 1 untracked"},
+		{"merging", Status{Branch: "main", Conflict: 2, Stashed: 1}, State{State: Merging}, nil, "On main, MERGING, 2 conflicts, 1 stash"},
+		{"rebasing", Status{Branch: "(detached)", Commit: "1234abcd5678"}, State{State: RebaseMerge, Step: 1, Total: 3}, nil, "Detached at 1234abc, REBASE-m 1/3, clean"},
+		{"large", Status{Branch: "main", Modified: 1234, Untracked: 56789}, State{State: RebaseMerge, Step: 999, Total: 1000}, groupDigits, "On main, REBASE-m 999/1,000, 1,234 modified, 56,789 untracked"},
+	}
+
+	for _, tt := range tests {
+		flags := testFlags()
+		if tt.flags != nil {
+			tt.flags(&flags)
+		}
+
+		if got := buildSummary(tt.status, tt.state, flags); got != tt.want {
+			t.Errorf("buildSummary() for a %s repository = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package gitstatus
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Backends reading the status of the repository.
+const (
+	BackendGit    = "git"
+	BackendNative = "native"
+)
+
+// nativeZeroHash stands in for the object names and modes of the status
+// records, which are not used.
+const (
+	nativeZeroHash = "0000000000000000000000000000000000000000"
+	nativeZeroMode = "000000"
+)
+
+// nativeConflictCodes are the porcelain v2 codes of unmerged paths, by which
+// of the ancestor (1), ours (2) and theirs (4) stages are in the index.
+var nativeConflictCodes = map[int]string{
+	1: "DD",
+	2: "AU",
+	3: "UD",
+	4: "UA",
+	5: "DU",
+	6: "AA",
+	7: "UU",
+}
+
+// nativeStatus reads the status of the working tree at path with go-git,
+// formatted like git status --porcelain=2 --branch so it can be parsed the
+// same way. Ignored files and dirty submodules are not reported, so the flags
+// asking for them are an error rather than having no effect.
+func nativeStatus(path, dir string, flags Flags) (string, error) {
+	switch {
+	case flags.ShowIgnored:
+		return "", errors.New("the native backend does not report ignored files for -show-ignored")
+	case flags.RecurseSubmodules:
+		return "", errors.New("the native backend does not report dirty submodules for -recurse-submodules")
+	}
+
+	if path == "" {
+		path = "."
+	}
+
+	repo, err := git.PlainOpenWithOptions(path, &git.PlainOpenOptions{DetectDotGit: true, EnableDotGitCommonDir: true})
+	if err != nil {
+		return "", fmt.Errorf("open repository: %w", err)
+	}
+
+	head, err := repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return "", fmt.Errorf("read HEAD: %w", err)
+	}
+
+	branch := "(detached)"
+	if head.Type() == plumbing.SymbolicReference {
+		branch = head.Target().Short()
+	}
+
+	oid := "(initial)"
+	commit, err := repo.Reference(plumbing.HEAD, true)
+	switch {
+	case errors.Is(err, plumbing.ErrReferenceNotFound):
+		// Unborn branch, there is no commit to refer to
+	case err != nil:
+		return "", fmt.Errorf("resolve HEAD: %w", err)
+	default:
+		oid = commit.Hash().String()
+	}
+
+	lines := []string{"# branch.oid " + oid, "# branch.head " + branch}
+
+	if branch != "(detached)" {
+		upstream, err := nativeUpstream(repo, branch, commit)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, upstream...)
+	}
+
+	if !flags.NoStash {
+		common, err := commonDir(dir)
+		if err != nil {
+			return "", err
+		}
+
+		// go-git does not read reflogs, each stash is a line of the stash
+		// reflog
+		b, err := os.ReadFile(filepath.Join(common, "logs", "refs", "stash"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("read stash reflog: %w", err)
+		}
+		if n := countLines(string(b)); n > 0 {
+			lines = append(lines, fmt.Sprintf("# stash %d", n))
+		}
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("open worktree: %w", err)
+	}
+
+	files, err := worktree.Status()
+	if err != nil {
+		return "", fmt.Errorf("read worktree status: %w", err)
+	}
+
+	// go-git reports unmerged and intent-to-add paths as changed, so they
+	// are read from the index instead
+	conflicts, intents, err := nativeIndexStatus(repo)
+	if err != nil {
+		return "", err
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	for path := range conflicts {
+		if _, ok := files[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+
+	for _, path := range paths {
+		if code, ok := conflicts[path]; ok {
+			lines = append(lines, strings.Join([]string{"u", code, "N...", nativeZeroMode, nativeZeroMode, nativeZeroMode, nativeZeroMode, nativeZeroHash, nativeZeroHash, nativeZeroHash, path}, " "))
+		} else if intents[path] {
+			lines = append(lines, strings.Join([]string{"1", ".A", "N...", nativeZeroMode, nativeZeroMode, nativeZeroMode, nativeZeroHash, nativeZeroHash, path}, " "))
+		} else if line := nativeStatusRecord(path, files[path], flags); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// nativeIndexStatus returns the porcelain v2 codes of the unmerged paths in
+// the index, and the paths added with git add -N.
+func nativeIndexStatus(repo *git.Repository) (map[string]string, map[string]bool, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, nil, fmt.Errorf("read index: %w", err)
+	}
+
+	stages := make(map[string]int)
+	intents := make(map[string]bool)
+	for _, entry := range idx.Entries {
+		if entry.IntentToAdd {
+			intents[entry.Name] = true
+		}
+
+		switch entry.Stage {
+		case index.AncestorMode:
+			stages[entry.Name] |= 1
+		case index.OurMode:
+			stages[entry.Name] |= 2
+		case index.TheirMode:
+			stages[entry.Name] |= 4
+		}
+	}
+
+	conflicts := make(map[string]string, len(stages))
+	for path, stage := range stages {
+		conflicts[path] = nativeConflictCodes[stage]
+	}
+
+	return conflicts, intents, nil
+}
+
+// nativeUpstream returns the upstream header lines of the branch, without
+// ahead/behind counts when the upstream is gone or the branch is unborn.
+func nativeUpstream(repo *git.Repository, branch string, commit *plumbing.Reference) ([]string, error) {
+	cfg, err := repo.Config()
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	b, ok := cfg.Branches[branch]
+	if !ok || b.Merge == "" {
+		return nil, nil
+	}
+
+	// A remote of "." tracks a local branch
+	ref := plumbing.NewRemoteReferenceName(b.Remote, b.Merge.Short())
+	upstream := b.Remote + "/" + b.Merge.Short()
+	if b.Remote == "." {
+		ref = b.Merge
+		upstream = b.Merge.Short()
+	}
+
+	lines := []string{"# branch.upstream " + upstream}
+
+	target, err := repo.Reference(ref, true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) || commit == nil {
+		return lines, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resolve upstream: %w", err)
+	}
+
+	ahead, behind, err := nativeAheadBehind(repo, commit.Hash(), target.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	return append(lines, fmt.Sprintf("# branch.ab +%d -%d", ahead, behind)), nil
+}
+
+// Sides of the history a commit is reachable from, while counting ahead and
+// behind.
+const (
+	nativeFromHead = 1 << iota
+	nativeFromUpstream
+	nativeFromBoth = nativeFromHead | nativeFromUpstream
+)
+
+// nativeSlop is how many commits to keep walking after the histories meet, in
+// case commit times are out of order, like git's revision walk.
+const nativeSlop = 5
+
+// nativeAheadBehind counts the commits head is ahead and behind upstream. Like
+// git, it walks both histories newest first, stopping once they meet rather
+// than walking each to the root.
+func nativeAheadBehind(repo *git.Repository, head, upstream plumbing.Hash) (int, int, error) {
+	sides := make(map[plumbing.Hash]int)
+	var queue nativeCommitQueue
+
+	// paint marks a commit reachable from side, queueing it again if that
+	// changes its sides so its parents are marked too
+	paint := func(hash plumbing.Hash, side int) error {
+		if sides[hash]&side == side {
+			return nil
+		}
+
+		commit, err := repo.CommitObject(hash)
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			// The history of shallow clones ends at missing parents
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read commit %s: %w", hash, err)
+		}
+
+		sides[hash] |= side
+		heap.Push(&queue, commit)
+		return nil
+	}
+
+	if err := paint(head, nativeFromHead); err != nil {
+		return 0, 0, err
+	}
+	if err := paint(upstream, nativeFromUpstream); err != nil {
+		return 0, 0, err
+	}
+
+	slop := nativeSlop
+	for queue.Len() > 0 {
+		// Commits reachable from both sides only have ancestors that are too
+		if !slices.ContainsFunc(queue, func(c *object.Commit) bool { return sides[c.Hash] != nativeFromBoth }) {
+			if slop == 0 {
+				break
+			}
+			slop--
+		} else {
+			slop = nativeSlop
+		}
+
+		commit := heap.Pop(&queue).(*object.Commit)
+		for _, parent := range commit.ParentHashes {
+			if err := paint(parent, sides[commit.Hash]); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	ahead, behind := 0, 0
+	for _, side := range sides {
+		switch side {
+		case nativeFromHead:
+			ahead++
+		case nativeFromUpstream:
+			behind++
+		}
+	}
+
+	return ahead, behind, nil
+}
+
+// nativeCommitQueue is a heap of commits, newest first.
+type nativeCommitQueue []*object.Commit
+
+func (q nativeCommitQueue) Len() int           { return len(q) }
+func (q nativeCommitQueue) Less(i, j int) bool { return q[i].Committer.When.After(q[j].Committer.When) }
+func (q nativeCommitQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *nativeCommitQueue) Push(x any) {
+	*q = append(*q, x.(*object.Commit))
+}
+
+func (q *nativeCommitQueue) Pop() any {
+	old := *q
+	commit := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return commit
+}
+
+// nativeStatusRecord formats the status of a file as a porcelain v2 record,
+// or returns an empty string if it is omitted.
+func nativeStatusRecord(path string, file *git.FileStatus, flags Flags) string {
+	staging, worktree := byte(file.Staging), byte(file.Worktree)
+
+	if staging == byte(git.Untracked) {
+		if flags.NoUntracked {
+			return ""
+		}
+		return "? " + path
+	}
+
+	// Unchanged columns are dots in porcelain v2
+	xy := strings.ReplaceAll(string([]byte{staging, worktree}), " ", ".")
+	if xy == ".." {
+		return ""
+	}
+
+	if staging == byte(git.Renamed) || staging == byte(git.Copied) {
+		return strings.Join([]string{"2", xy, "N...", nativeZeroMode, nativeZeroMode, nativeZeroMode, nativeZeroHash, nativeZeroHash, "R100", path + "\t" + file.Extra}, " ")
+	}
+
+	return strings.Join([]string{"1", xy, "N...", nativeZeroMode, nativeZeroMode, nativeZeroMode, nativeZeroHash, nativeZeroHash, path}, " ")
+}
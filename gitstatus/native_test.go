@@ -0,0 +1,94 @@
+package gitstatus
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestNativeAheadBehind(t *testing.T) {
+	dir := testRepo(t)
+
+	// commit makes n commits on branch, created from start unless empty,
+	// dated step seconds apart
+	date := 1700000000
+	commit := func(branch, start string, n, step int) {
+		t.Helper()
+
+		if start != "" {
+			runTestGit(t, dir, "checkout", "-q", "-b", branch, start)
+		} else {
+			runTestGit(t, dir, "checkout", "-q", branch)
+		}
+		for range n {
+			date += step
+			t.Setenv("GIT_COMMITTER_DATE", fmt.Sprintf("%d +0000", date))
+			runTestGit(t, dir, "commit", "-q", "--allow-empty", "-m", branch)
+		}
+	}
+
+	commit("ahead", "main", 3, 60)
+	commit("up", "main", 2, 60)
+	commit("diverged", "main", 4, 60)
+	commit("merged", "ahead", 1, 60)
+	runTestGit(t, dir, "merge", "-q", "--no-edit", "up")
+	// Commits dated before their parents, e.g. from a skewed clock
+	commit("skewed", "up", 8, -3600)
+	commit("long", "main", 40, 60)
+
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct{ head, upstream string }{
+		{"main", "main"},
+		{"ahead", "main"},
+		{"main", "ahead"},
+		{"diverged", "up"},
+		{"merged", "up"},
+		{"up", "merged"},
+		{"skewed", "ahead"},
+		{"ahead", "skewed"},
+		{"long", "skewed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.head+"..."+tt.upstream, func(t *testing.T) {
+			var wantBehind, wantAhead int
+			counts := runTestGit(t, dir, "rev-list", "--left-right", "--count", tt.upstream+"..."+tt.head)
+			if _, err := fmt.Sscan(strings.TrimSpace(counts), &wantBehind, &wantAhead); err != nil {
+				t.Fatal(err)
+			}
+
+			head := plumbing.NewHash(strings.TrimSpace(runTestGit(t, dir, "rev-parse", tt.head)))
+			upstream := plumbing.NewHash(strings.TrimSpace(runTestGit(t, dir, "rev-parse", tt.upstream)))
+			ahead, behind, err := nativeAheadBehind(repo, head, upstream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ahead != wantAhead || behind != wantBehind {
+				t.Errorf("nativeAheadBehind() = %d, %d, want %d, %d", ahead, behind, wantAhead, wantBehind)
+			}
+		})
+	}
+}
+
+func TestNativeUnsupportedFlags(t *testing.T) {
+	dir := testRepo(t)
+
+	for name, set := range map[string]func(*Flags){
+		"show-ignored":       func(f *Flags) { f.ShowIgnored = true },
+		"recurse-submodules": func(f *Flags) { f.RecurseSubmodules = true },
+	} {
+		flags := testFlags()
+		flags.Backend = BackendNative
+		set(&flags)
+		if _, err := Render(dir, flags); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("Render() with -%s = %v, want an error naming it", name, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package gitstatus
+
+import "strings"
+
+// powerlineColors are the background colors of the powerline segments.
+var powerlineColors = struct {
+	Branch    string
+	State     string
+	Staged    string
+	Renamed   string
+	Conflict  string
+	Modified  string
+	Deleted   string
+	Submodule string
+	Intent    string
+	Untracked string
+	Ignored   string
+	Stashed   string
+	Clean     string
+}{
+	Branch:    "blue",
+	State:     "magenta",
+	Staged:    "green",
+	Renamed:   "bright-green",
+	Conflict:  "red",
+	Modified:  "yellow",
+	Deleted:   "bright-red",
+	Submodule: "bright-yellow",
+	Intent:    "bright-cyan",
+	Untracked: "cyan",
+	Ignored:   "bright-black",
+	Stashed:   "white",
+	Clean:     "green",
+}
+
+// powerlineSegment is a single powerline segment and its background color.
+type powerlineSegment struct {
+	text  string
+	color string
+}
+
+// buildPowerline builds the status as powerline segments with background
+// colors, joined by the powerline separator symbol.
+func buildPowerline(status Status, state State, flags Flags) string {
+	symbols := flags.Symbols
+
+	if flags.HideClean && !status.Bare && isClean(status, flags) && state.State == "" && status.Ahead == 0 && status.Behind == 0 {
+		return ""
+	}
+
+	// Segments are colored as a whole, so their contents are written plain
+	plain := flags
+	plain.Colors = Colors{}
+
+	var segments []powerlineSegment
+	add := func(color string, write func(b *strings.Builder)) {
+		var b strings.Builder
+		write(&b)
+		segments = append(segments, powerlineSegment{text: b.String(), color: color})
+	}
+
+	if status.Bare {
+		if status.Branch != "" {
+			add(powerlineColors.Branch, func(b *strings.Builder) { b.WriteString(shellEscape(status.Branch, flags)) })
+		}
+		add(powerlineColors.State, func(b *strings.Builder) { b.WriteString(flags.BareLabel) })
+
+		return writePowerline(segments, flags)
+	}
+
+	if !flags.NoBranch {
+		add(powerlineColors.Branch, func(b *strings.Builder) {
+			writeBranch(b, status, plain)
+			if !isClean(status, flags) {
+				b.WriteString(symbols.Dirty)
+			}
+		})
+	}
+	if state.State != "" {
+		add(powerlineColors.State, func(b *strings.Builder) { writeState(b, state, plain) })
+	}
+	if status.Staged > 0 {
+		add(powerlineColors.Staged, func(b *strings.Builder) { writeCount(b, "", symbols.Staged, status.Staged, plain) })
+	}
+	if status.Renamed > 0 {
+		add(powerlineColors.Renamed, func(b *strings.Builder) { writeCount(b, "", symbols.Renamed, status.Renamed, plain) })
+	}
+	if status.Conflict > 0 {
+		add(powerlineColors.Conflict, func(b *strings.Builder) { writeCount(b, "", symbols.Conflict, status.Conflict, plain) })
+	}
+	if status.Modified > 0 {
+		add(powerlineColors.Modified, func(b *strings.Builder) { writeCount(b, "", symbols.Modified, status.Modified, plain) })
+	}
+	if status.Deleted > 0 {
+		add(powerlineColors.Deleted, func(b *strings.Builder) { writeCount(b, "", symbols.Deleted, status.Deleted, plain) })
+	}
+	if status.SubmodulesDirty > 0 {
+		add(powerlineColors.Submodule, func(b *strings.Builder) { writeCount(b, "", symbols.Submodule, status.SubmodulesDirty, plain) })
+	}
+	if status.IntentToAdd > 0 {
+		add(powerlineColors.Intent, func(b *strings.Builder) { writeCount(b, "", symbols.Intent, status.IntentToAdd, plain) })
+	}
+	if status.Untracked > 0 {
+		add(powerlineColors.Untracked, func(b *strings.Builder) { writeCount(b, "", symbols.Untracked, status.Untracked, plain) })
+	}
+	if status.Ignored > 0 {
+		add(powerlineColors.Ignored, func(b *strings.Builder) { writeCount(b, "", symbols.Ignored, status.Ignored, plain) })
+	}
+	if status.Stashed > 0 {
+		add(powerlineColors.Stashed, func(b *strings.Builder) { writeCount(b, "", symbols.Stashed, status.Stashed, plain) })
+	}
+	if isClean(status, flags) {
+		add(powerlineColors.Clean, func(b *strings.Builder) { b.WriteString(symbols.Clean) })
+	}
+
+	return writePowerline(segments, flags)
+}
+
+// writePowerline joins the segments, coloring each separator with the
+// background colors of the segments on either side of it.
+func writePowerline(segments []powerlineSegment, flags Flags) string {
+	var b strings.Builder
+	for i, s := range segments {
+		sep := s.color
+		if i+1 < len(segments) {
+			sep += " " + segments[i+1].color
+		}
+
+		if flags.Color == ColorNever {
+			s.color, sep = "", ""
+		} else {
+			s.color = "black " + s.color
+		}
+
+		writeColored(&b, s.color, " "+strings.TrimSpace(s.text)+" ", flags)
+		writeColored(&b, sep, flags.Symbols.Powerline, flags)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,42 @@
+package gitstatus
+
+import "strings"
+
+// Shells the output can be embedded in.
+const (
+	ShellNone = ""
+	ShellZsh  = "zsh"
+	ShellBash = "bash"
+)
+
+// shellEscape escapes text so the shell, or tmux, prints it literally.
+func shellEscape(text string, flags Flags) string {
+	if flags.Output == OutputTmux {
+		// tmux would otherwise expand formats such as #[fg=red]
+		text = strings.ReplaceAll(text, "#", "##")
+	}
+
+	switch flags.Shell {
+	case ShellZsh:
+		return strings.ReplaceAll(text, "%", "%%")
+	case ShellBash:
+		// PS1 is expanded like a double-quoted string, and bash decodes \$
+		// to a literal $, or # for root
+		return strings.NewReplacer(`\`, `\\`, "`", "\\`", "$", `\$`).Replace(text)
+	default:
+		return text
+	}
+}
+
+// shellNonPrinting wraps a non-printing sequence so the shell does not count
+// it towards the prompt width.
+func shellNonPrinting(seq string, flags Flags) string {
+	switch flags.Shell {
+	case ShellZsh:
+		return "%{" + seq + "%}"
+	case ShellBash:
+		return `\[` + seq + `\]`
+	default:
+		return seq
+	}
+}
@@ -0,0 +1,68 @@
+package gitstatus
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShellEscape(t *testing.T) {
+	tests := []struct {
+		shell, output string
+		text, want    string
+	}{
+		{ShellNone, OutputANSI, `a$b\c`, `a$b\c`},
+		{ShellZsh, OutputANSI, "100%", "100%%"},
+		{ShellBash, OutputANSI, `a\b`, `a\\b`},
+		{ShellBash, OutputANSI, "a`b`", "a\\`b\\`"},
+		{ShellBash, OutputANSI, "x$(touch${IFS}pwned)", `x\$(touch\${IFS}pwned)`},
+		{ShellNone, OutputTmux, "#[fg=red]", "##[fg=red]"},
+	}
+
+	for _, tt := range tests {
+		got := shellEscape(tt.text, Flags{Shell: tt.shell, Output: tt.output})
+		if got != tt.want {
+			t.Errorf("shellEscape(%q) with shell %q, output %s = %q, want %q", tt.text, tt.shell, tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestBashPromptSubstitution(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not found")
+	}
+
+	dir := testRepo(t)
+	pwned := filepath.Join(t.TempDir(), "pwned")
+	branch := "x$(touch${IFS}" + pwned + ")"
+	runTestGit(t, dir, "checkout", "-q", "-b", branch)
+
+	flags := testFlags()
+	flags.Shell = ShellBash
+	output, err := Render(dir, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expand the output like bash expands PS1
+	prompt, err := exec.Command(bash, "-c", `PS1="$1"; printf %s "${PS1@P}"`, "bash", output).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(pwned); err == nil {
+		t.Fatalf("expanding the prompt ran the command in the branch name")
+	}
+
+	// Bash shows \$ as # for root
+	dollar := "$"
+	if os.Geteuid() == 0 {
+		dollar = "#"
+	}
+	if want := "[" + strings.ReplaceAll(branch, "$", dollar) + " L|ok]"; string(prompt) != want {
+		t.Errorf("prompt = %q, want %q", prompt, want)
+	}
+}
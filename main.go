@@ -1,345 +1,521 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"slices"
-	"strconv"
 	"strings"
-)
-
-// Status represents the status of a Git repository.
-type Status struct {
-	Commit    string
-	Branch    string
-	Upstream  string
-	Ahead     int
-	Behind    int
-	Staged    int
-	Conflict  int
-	Modified  int
-	Untracked int
-	Stashed   int
-}
+	"unicode"
 
-// State represents the state of a Git repository during a specific operation.
-type State struct {
-	Step  int
-	Total int
-	State string
-}
+	"github.com/eric-carlsson/compact-git-status/gitstatus"
+)
 
+// Exit codes, 2 is used by the flag package for invalid usage.
 const (
-	RebaseApply       string = "REBASE"
-	RebaseMerge              = "REBASE-m"
-	RebaseInteractive        = "REBASE-i"
-	Am                       = "AM"
-	AmRebase                 = "AM/REBASE"
-	Merging                  = "MERGING"
-	CherryPick               = "CHERRY-PICKING"
-	Reverting                = "REVERTING"
-	Bisecting                = "BISECTING"
+	exitError    = 1
+	exitParse    = 3
+	exitGit      = 4
+	exitConflict = 5
 )
 
-// Symbols represents the symbols used to display the Git repository status.
-type Symbols struct {
-	Prefix    string
-	Suffix    string
-	Sep       string
-	Local     string
-	Ahead     string
-	Behind    string
-	Staged    string
-	Conflict  string
-	Modified  string
-	Untracked string
-	Stashed   string
-	Clean     string
-	Nop       string
+// asciiSymbols are ASCII fallbacks for the default symbols.
+var asciiSymbols = gitstatus.Symbols{
+	Prefix:    "[",
+	Suffix:    "]",
+	Sep:       "|",
+	Local:     "L",
+	LocalSep:  " ",
+	Ahead:     "^",
+	Behind:    "v",
+	PushHint:  ">",
+	PullHint:  "<",
+	SyncHint:  "<>",
+	Even:      "=",
+	Gone:      "gone",
+	Push:      "push:",
+	Base:      "base:",
+	Tag:       "tag:",
+	Signed:    "sig",
+	Locked:    "#",
+	IndexLock: "&",
+	Shallow:   "~",
+	Sparse:    "%",
+	Promisor:  "p",
+	Protected: "!",
+	Hash:      "@",
+	Staged:    "*",
+	Renamed:   "r",
+	Conflict:  "x",
+	Modified:  "+",
+	Deleted:   "-",
+	Intent:    "i",
+	Untracked: "?",
+	Ignored:   "!",
+	Submodule: "s",
+	Stashed:   "$",
+	Autostash: "+stash",
+	Dirty:     "*",
+	Clean:     "ok",
+	Nop:       " ",
+	Powerline: ">",
+
+	StagedDeleted: "-",
+	DeletedByUs:   "-u",
+	DeletedByThem: "-t",
+	BadSignature:  "sig!",
+	SparseIndex:   "%i",
 }
 
-type Flags struct {
-	Path         string
-	ShowUpstream bool
-	Symbols      Symbols
+// symbolSets are the built-in symbol sets selectable with -symbols.
+var symbolSets = map[string]gitstatus.Symbols{
+	"ascii": func() gitstatus.Symbols {
+		// The dirty marker is opt-in, so it is left unset
+		symbols := asciiSymbols
+		symbols.Dirty = ""
+		return symbols
+	}(),
+	"nerd": {
+		Ahead:     "\uf062",
+		Behind:    "\uf063",
+		PushHint:  "\uf0aa",
+		PullHint:  "\uf0ab",
+		SyncHint:  "\uf0ec",
+		Locked:    "\uf023",
+		Protected: "\uf071",
+		Hash:      "\uf417",
+		Staged:    "\uf111 ",
+		Renamed:   "\uf061 ",
+		Conflict:  "\uf00d ",
+		Modified:  "\uf040 ",
+		Deleted:   "\uf014 ",
+		Intent:    "\uf067 ",
+		Untracked: "\uf128 ",
+		Ignored:   "\uf070 ",
+		Submodule: "\uf1b2 ",
+		Stashed:   "\uf024 ",
+		Clean:     "\uf00c",
+		Branch:    "\uf418 ",
+	},
+}
+
+// commandFlags are the command line flags that change what the command does
+// around rendering the status, rather than what is rendered.
+type commandFlags struct {
+	FD             int
+	ASCIISafe      bool
+	Probe          bool
+	FailOnConflict bool
+	SymbolSet      string
+	SymbolsFile    string
+	Theme          string
+	Config         string
+	Profile        string
 }
 
 // main is the entry point of the program.
 func main() {
-	flags := Flags{Symbols: Symbols{}}
+	flags := gitstatus.DefaultFlags()
+	var command commandFlags
 	flag.StringVar(&flags.Path, "path", "", "Path to the git repository (default current working directory)")
 	flag.BoolVar(&flags.ShowUpstream, "show-upstream", false, "Show the upstream branch")
-	flag.StringVar(&flags.Symbols.Prefix, "symbol-prefix", "[", "Prefix symbol")
-	flag.StringVar(&flags.Symbols.Suffix, "symbol-suffix", "]", "Suffix symbol")
-	flag.StringVar(&flags.Symbols.Sep, "symbol-sep", "|", "Separator symbol")
-	flag.StringVar(&flags.Symbols.Local, "symbol-local", "L", "Local branch symbol")
-	flag.StringVar(&flags.Symbols.Modified, "symbol-modified", "✚ ", "Modified symbol")
-	flag.StringVar(&flags.Symbols.Staged, "symbol-staged", "● ", "Staged symbol")
-	flag.StringVar(&flags.Symbols.Conflict, "symbol-conflict", "✖ ", "Conflict symbol")
-	flag.StringVar(&flags.Symbols.Untracked, "symbol-untracked", "…", "Untracked symbol")
-	flag.StringVar(&flags.Symbols.Stashed, "symbol-stashed", "⚑ ", "Stashed symbol")
-	flag.StringVar(&flags.Symbols.Ahead, "symbol-ahead", "↑·", "Ahead symbol")
-	flag.StringVar(&flags.Symbols.Behind, "symbol-behind", "↓·", "Behind symbol")
-	flag.StringVar(&flags.Symbols.Clean, "symbol-clean", "✔", "Clean symbol")
-	flag.StringVar(&flags.Symbols.Nop, "symbol-nop", " ", "No operation symbol")
+	flag.BoolVar(&flags.JSON, "json", false, "Print the status as JSON")
+	flag.BoolVar(&flags.IconsOnly, "icons-only", false, "Show symbols without their counts")
+	flag.BoolVar(&flags.ShowHints, "show-hints", false, "Show push/pull hints after the ahead/behind counts")
+	flag.BoolVar(&flags.ComputeAB, "compute-ab", false, "Compute ahead/behind with rev-list when git status does not report it")
+	flag.BoolVar(&flags.Churn, "churn", false, "Show the number of added and removed lines")
+	flag.IntVar(&flags.MaxCount, "max-count", 0, "Cap displayed counts, rendering larger ones as <max>+ (0 disables)")
+	flag.BoolVar(&flags.ShowAutostash, "show-autostash", false, "Show when a rebase has auto-stashed changes")
+	flag.Var(newEnumValue(&flags.Color, gitstatus.ColorAuto, gitstatus.ColorAlways, gitstatus.ColorNever), "color", "When to color the output: auto, always or never")
+	flag.Var((*colorValue)(&flags.Colors.Branch), "color-branch", "Branch color, e.g. yellow, \"bold red\", 208 or #ff8700")
+	flag.Var((*colorValue)(&flags.Colors.State), "color-state", "Operation state color, e.g. \"bold reverse red\"")
+	flag.Var((*colorValue)(&flags.Colors.Ahead), "color-ahead", "Ahead color")
+	flag.Var((*colorValue)(&flags.Colors.Behind), "color-behind", "Behind color")
+	flag.Var((*colorValue)(&flags.Colors.Staged), "color-staged", "Staged color")
+	flag.Var((*colorValue)(&flags.Colors.Conflict), "color-conflict", "Conflict color")
+	flag.Var((*colorValue)(&flags.Colors.Modified), "color-modified", "Modified color")
+	flag.Var((*colorValue)(&flags.Colors.Untracked), "color-untracked", "Untracked color")
+	flag.Var((*colorValue)(&flags.Colors.Stashed), "color-stashed", "Stashed color")
+	flag.Var((*colorValue)(&flags.Colors.Clean), "color-clean", "Clean color")
+	flag.Var(newEnumValue(&flags.Shell, gitstatus.ShellNone, gitstatus.ShellZsh, gitstatus.ShellBash), "shell", "Shell prompt to escape the output for: zsh or bash")
+	flag.Var(newEnumValue(&flags.Output, gitstatus.OutputANSI, gitstatus.OutputTmux), "output", "Output format for colors: ansi or tmux")
+	flag.BoolVar(&flags.GitColors, "git-colors", false, "Color segments using the color.status.* git config")
+	flag.IntVar(&command.FD, "fd", 1, "File descriptor to write the output to")
+	flag.BoolVar(&command.ASCIISafe, "ascii-safe", false, "Replace symbols containing non-ASCII characters with ASCII fallbacks")
+	flag.BoolVar(&flags.Files, "files", false, "Include the changed files in the JSON output")
+	flag.BoolVar(&flags.CheckEven, "check-even", false, "Show a symbol when HEAD is the same commit as its upstream")
+	flag.BoolVar(&flags.BehindFirst, "behind-first", false, "Show the behind count before the ahead count")
+	flag.BoolVar(&flags.HideOpDetached, "hide-op-detached", false, "Hide the detached commit while an operation is in progress")
+	flag.BoolVar(&flags.GroupDigits, "group-digits", false, "Group the digits of numbers into thousands")
+	flag.StringVar(&flags.DigitSep, "digit-sep", flags.DigitSep, "Thousands separator used with -group-digits")
+	flag.BoolVar(&flags.EmptyBrackets, "empty-brackets", false, "Print the prefix and suffix symbols when not in a git repository")
+	flag.BoolVar(&flags.SplitModified, "split-modified", false, "Show staged and modified files as a single staged/unstaged segment")
+	flag.Var(&flags.ShowSubject, "show-subject", "Show the subject of the HEAD commit, truncated to the given length with -show-subject=N")
+	flag.BoolVar(&flags.BranchStashes, "branch-stashes", false, "Only count the stashes made on the current branch")
+	flag.Var(&flags.ShowStashMessage, "show-stash-message", "Show the subject of the most recent stash, truncated to the given length with -show-stash-message=N")
+	flag.BoolVar(&flags.ShowSignature, "show-signature", false, "Show whether the HEAD commit is signed and the signature verifies")
+	flag.BoolVar(&flags.ShowAge, "show-age", false, "Show the time since the last commit")
+	flag.DurationVar(&flags.StaleAfter, "stale-after", flags.StaleAfter, "Age after which the last commit is colored with -color-stale (0 disables)")
+	flag.Var((*colorValue)(&flags.Colors.Age), "color-age", "Last commit age color")
+	flag.Var((*colorValue)(&flags.Colors.Stale), "color-stale", "Last commit age color once older than -stale-after")
+	flag.BoolVar(&flags.ShowTag, "show-tag", false, "Show the nearest tag and the number of commits since it")
+	flag.BoolVar(&flags.Describe, "describe", false, "Name a detached HEAD with git describe --tags instead of its commit")
+	flag.BoolVar(&flags.ShowBase, "show-base", false, "Show the number of commits HEAD is ahead of the base branch")
+	flag.StringVar(&flags.Base, "base", flags.Base, "Base branch for -show-base")
+	flag.BoolVar(&flags.ShowPush, "show-push", false, "Show ahead/behind counts of the push destination when it differs from the upstream")
+	flag.BoolVar(&flags.RecurseSubmodules, "recurse-submodules", false, "Include the files changed in dirty submodules in the counts")
+	flag.BoolVar(&flags.ShowIgnored, "show-ignored", false, "Show the number of ignored files")
+	flag.BoolVar(&flags.NoStash, "no-stash", false, "Omit the stash count")
+	flag.BoolVar(&flags.NoUntracked, "no-untracked", false, "Omit untracked files, without scanning for them")
+	flag.BoolVar(&flags.NoUpstream, "no-upstream", false, "Omit the upstream branch and ahead/behind counts")
+	flag.BoolVar(&flags.NoState, "no-state", false, "Omit the operation state")
+	flag.BoolVar(&flags.NoBranch, "no-branch", false, "Omit the branch, upstream and ahead/behind segment")
+	flag.StringVar(&flags.Against, "against", "", "Count staged changes against the given revision instead of HEAD")
+	flag.BoolVar(&flags.StashFallback, "stash-fallback", false, "Count stashes with git stash list when git status does not report them")
+	flag.IntVar(&flags.PatchLength, "patch-length", flags.PatchLength, "Length to truncate the subject of the patch being applied by git am to (0 hides it)")
+	flag.BoolVar(&flags.ShowTodo, "show-todo", false, "Show the remaining actions of an interactive rebase, e.g. 2 pick, 1 squash")
+	flag.BoolVar(&flags.CompactState, "compact-state", false, "Abbreviate the operation state")
+	flag.BoolVar(&flags.HideClean, "hide-clean", false, "Print nothing when the repository is clean and in sync")
+	flag.StringVar(&flags.ProtectedBranches, "protected-branches", "", "Comma separated list of branches to mark as protected")
+	flag.Var(newEnumValue(&flags.StatePosition, gitstatus.StatePositionAfterBranch, gitstatus.StatePositionEnd), "state-position", "Position of the operation state: after-branch or end")
+	flag.BoolVar(&flags.IncludeRaw, "include-raw", false, "Include the raw git status output in the JSON output")
+	flag.BoolVar(&flags.ABFraction, "ab-fraction", false, "Show ahead and behind as fractions of the total divergence")
+	flag.BoolVar(&flags.UntrackedIsClean, "untracked-is-clean", false, "Do not let untracked files prevent the clean symbol")
+	flag.BoolVar(&command.Probe, "probe", false, "Only print whether the path is inside a git working tree, exiting 1 if not")
+	flag.BoolVar(&flags.Superproject, "superproject", false, "Show the status of the superproject when inside a submodule")
+	flag.StringVar(&flags.BareLabel, "bare-label", flags.BareLabel, "Label shown in place of the counts in a bare repository")
+	flag.BoolVar(&flags.ShowHash, "show-hash", false, "Show the commit hash after the branch name")
+	flag.IntVar(&flags.HashLength, "hash-length", flags.HashLength, "Length of the commit hash shown with -show-hash")
+	flag.IntVar(&flags.FixedWidth, "fixed-width", 0, "Right-justify counts to the given width")
+	flag.BoolVar(&command.FailOnConflict, "fail-on-conflict", false, "Exit with code 5 when there are conflicts")
+	flag.Var(newEnumValue(&flags.LocalPosition, gitstatus.LocalPositionAfter, gitstatus.LocalPositionBefore, gitstatus.LocalPositionNone), "local-position", "Position of the local branch symbol: after, before or none")
+	flag.BoolVar(&flags.JSONNumbersAsStrings, "json-numbers-as-strings", false, "Print numbers as strings in the JSON output")
+	flag.BoolVar(&flags.ShowStashConflict, "show-stash-conflict", false, "Show a state for conflicts likely left by applying a stash")
+	flag.BoolVar(&flags.Summary, "summary", false, "Print a plain English summary instead of symbols")
+	flag.BoolVar(&flags.Verbose, "verbose", false, "Also list the conflicted, modified and staged files on the following lines")
+	flag.IntVar(&flags.VerboseFiles, "verbose-files", flags.VerboseFiles, "Number of files listed with -verbose")
+	flag.BoolVar(&flags.Powerline, "powerline", false, "Print the status as powerline segments")
+	flag.StringVar(&flags.Format, "format", "", "Go text/template for the output, with .Status, .State and .Symbols")
+	flag.BoolVar(&flags.StashIgnoresClean, "stash-ignores-clean", false, "Do not let stashed entries prevent the clean symbol")
+	flag.StringVar(&flags.Symbols.Prefix, "symbol-prefix", flags.Symbols.Prefix, "Prefix symbol")
+	flag.StringVar(&flags.Symbols.Suffix, "symbol-suffix", flags.Symbols.Suffix, "Suffix symbol")
+	flag.StringVar(&flags.Symbols.Sep, "symbol-sep", flags.Symbols.Sep, "Separator symbol")
+	flag.StringVar(&flags.Symbols.StateSep, "state-sep", "", "Separator symbol around the operation state (default separator symbol)")
+	flag.StringVar(&flags.Symbols.Local, "symbol-local", flags.Symbols.Local, "Local branch symbol")
+	flag.StringVar(&flags.Symbols.LocalSep, "local-sep", flags.Symbols.LocalSep, "Separator between the branch name and the local branch symbol")
+	flag.StringVar(&flags.Symbols.Renamed, "symbol-renamed", flags.Symbols.Renamed, "Symbol for renamed or copied files")
+	flag.StringVar(&flags.Symbols.Modified, "symbol-modified", flags.Symbols.Modified, "Modified symbol")
+	flag.StringVar(&flags.Symbols.Deleted, "symbol-deleted", flags.Symbols.Deleted, "Symbol for files deleted in the working tree")
+	flag.StringVar(&flags.Symbols.Staged, "symbol-staged", flags.Symbols.Staged, "Staged symbol")
+	flag.StringVar(&flags.Symbols.StagedDeleted, "symbol-staged-deleted", "", "Staged deletion symbol, shown after the staged count (default none)")
+	flag.StringVar(&flags.Symbols.Conflict, "symbol-conflict", flags.Symbols.Conflict, "Conflict symbol")
+	flag.StringVar(&flags.Symbols.DeletedByUs, "symbol-deleted-by-us", "", "Deleted by us conflict symbol, shown after the conflict count (default none)")
+	flag.StringVar(&flags.Symbols.DeletedByThem, "symbol-deleted-by-them", "", "Deleted by them conflict symbol, shown after the conflict count (default none)")
+	flag.StringVar(&flags.Symbols.Intent, "symbol-intent", flags.Symbols.Intent, "Symbol for intent-to-add files")
+	flag.StringVar(&flags.Symbols.Untracked, "symbol-untracked", flags.Symbols.Untracked, "Untracked symbol")
+	flag.StringVar(&flags.Symbols.Ignored, "symbol-ignored", flags.Symbols.Ignored, "Symbol for ignored files shown with -show-ignored")
+	flag.StringVar(&flags.Symbols.Submodule, "symbol-submodule", flags.Symbols.Submodule, "Symbol for dirty submodules")
+	flag.StringVar(&flags.Symbols.Stashed, "symbol-stashed", flags.Symbols.Stashed, "Stashed symbol")
+	flag.StringVar(&flags.Symbols.Autostash, "symbol-autostash", flags.Symbols.Autostash, "Rebase autostash symbol")
+	flag.StringVar(&flags.Symbols.Ahead, "symbol-ahead", flags.Symbols.Ahead, "Ahead symbol")
+	flag.StringVar(&flags.Symbols.Behind, "symbol-behind", flags.Symbols.Behind, "Behind symbol")
+	flag.StringVar(&flags.Symbols.PushHint, "push-hint", flags.Symbols.PushHint, "Push hint symbol")
+	flag.StringVar(&flags.Symbols.PullHint, "pull-hint", flags.Symbols.PullHint, "Pull hint symbol")
+	flag.StringVar(&flags.Symbols.SyncHint, "sync-hint", flags.Symbols.SyncHint, "Sync hint symbol")
+	flag.StringVar(&flags.Symbols.Push, "symbol-push", flags.Symbols.Push, "Symbol before the ahead/behind counts of the push destination")
+	flag.StringVar(&flags.Symbols.Signed, "symbol-signed", flags.Symbols.Signed, "Symbol for a HEAD commit with a good signature")
+	flag.StringVar(&flags.Symbols.Unsigned, "symbol-unsigned", "", "Symbol for an unsigned HEAD commit (default none)")
+	flag.StringVar(&flags.Symbols.BadSignature, "symbol-bad-signature", flags.Symbols.BadSignature, "Symbol for a HEAD commit with a bad or unverifiable signature")
+	flag.StringVar(&flags.Symbols.Tag, "symbol-tag", flags.Symbols.Tag, "Symbol before the nearest tag")
+	flag.StringVar(&flags.Symbols.Base, "symbol-base", flags.Symbols.Base, "Symbol for the number of commits ahead of the base branch")
+	flag.StringVar(&flags.Symbols.Gone, "symbol-gone", flags.Symbols.Gone, "Symbol for an upstream branch that no longer exists")
+	flag.StringVar(&flags.Symbols.Even, "even", flags.Symbols.Even, "Symbol for HEAD being the same commit as its upstream")
+	flag.StringVar(&flags.Symbols.Locked, "worktree-locked", flags.Symbols.Locked, "Locked worktree symbol")
+	flag.StringVar(&flags.Symbols.IndexLock, "symbol-index-lock", flags.Symbols.IndexLock, "Symbol for an index locked by another git process")
+	flag.StringVar(&flags.Symbols.Shallow, "symbol-shallow", flags.Symbols.Shallow, "Symbol for a shallow clone")
+	flag.StringVar(&flags.Symbols.Sparse, "symbol-sparse", flags.Symbols.Sparse, "Symbol for a sparse checkout")
+	flag.StringVar(&flags.Symbols.Promisor, "symbol-promisor", flags.Symbols.Promisor, "Symbol for a partial clone")
+	flag.StringVar(&flags.Symbols.SparseIndex, "symbol-sparse-index", flags.Symbols.SparseIndex, "Symbol for a sparse checkout with a sparse index, with -show-sparse-index")
+	flag.BoolVar(&flags.ShowSparseIndex, "show-sparse-index", false, "Show when a sparse checkout also uses a sparse index")
+	flag.StringVar(&flags.Symbols.Protected, "protected", flags.Symbols.Protected, "Protected branch symbol")
+	flag.StringVar(&flags.Symbols.Hash, "symbol-hash", flags.Symbols.Hash, "Commit hash symbol")
+	flag.StringVar(&flags.Symbols.Dirty, "dirty-marker", "", "Symbol shown after the branch when the working tree is dirty")
+	flag.StringVar(&flags.Symbols.Clean, "symbol-clean", flags.Symbols.Clean, "Clean symbol")
+	flag.StringVar(&flags.Symbols.Nop, "symbol-nop", flags.Symbols.Nop, "No operation symbol")
+	flag.StringVar(&flags.Symbols.Branch, "symbol-branch", "", "Symbol shown before the branch name")
+	flag.Var(newEnumValue(&command.SymbolSet, append([]string{""}, sortedKeys(symbolSets)...)...), "symbols", "Built-in symbol set replacing the default symbols: ascii or nerd")
+	flag.StringVar(&command.SymbolsFile, "symbols-file", "", "JSON or TOML file of symbols replacing the default symbols")
+	flag.Var(newEnumValue(&command.Theme, append([]string{""}, sortedKeys(themes)...)...), "theme", "Built-in theme of symbols and colors: minimal, classic, nerd, emoji or monochrome")
+	flag.StringVar(&flags.Symbols.Powerline, "symbol-powerline", flags.Symbols.Powerline, "Powerline separator symbol")
+	flag.Var(newEnumValue(&flags.Backend, gitstatus.BackendGit, gitstatus.BackendNative), "backend", "Backend reading the status: git, or native to read the repository with go-git without running git")
+	flag.StringVar(&command.Config, "config", "", "Path to the configuration file (default ~/.config/compact-git-status/config.toml)")
+	flags.StateLabels = make(gitstatus.StateLabels)
+	flag.Var(flags.StateLabels, "state-labels", "Comma separated STATE=LABEL pairs replacing state names, e.g. MERGING=MG,REBASE-i=RB")
+	flag.StringVar(&command.Profile, "profile", "", "Profile of the configuration file to use")
 	flag.Parse()
 
-	state, err := gitState(flags.Path)
-	if err != nil {
-		log.Fatal(err)
+	flag.Visit(func(f *flag.Flag) {
+		optionSources[f.Name] = "command line"
+	})
+
+	// The command line takes precedence over the environment, which can
+	// name the configuration file
+	if err := loadEnv(); err != nil {
+		fatal(err)
 	}
 
-	if state == nil {
-		// Nil state means not in a git repository
-		fmt.Print(flags.Symbols.Nop)
+	// The config subcommand runs before the options are loaded, so it can
+	// set or validate options in a configuration file that fails to load
+	if flag.Arg(0) == "config" {
+		if err := runConfig(flag.Args()[1:], os.Stdout, command.Config, func() error {
+			_, err := loadOptions(flags.Path, command.Config, command.Profile)
+			return err
+		}); err != nil {
+			fatal(err)
+		}
 		return
 	}
 
-	output, err := gitStatus(flags.Path)
+	out, err := openFD(command.FD)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	status, err := parseStatus(output)
-	if err != nil {
-		log.Fatal(err)
-	}
+	if command.Probe {
+		// Probing only needs the repository, not the rest of the options
+		repo, err := gitstatus.LookupRepo(flags.Path, "")
+		if err != nil {
+			fatal(err)
+		}
 
-	fmt.Print(buildOutput(*status, *state, flags.Symbols, flags.ShowUpstream))
-}
+		inside := repo.TopLevel != ""
+		fmt.Fprint(out, inside)
+		if !inside {
+			os.Exit(exitError)
+		}
+		return
+	}
 
-// gitState retrieves the current state of the Git repository.
-func gitState(path string) (*State, error) {
-	stdout, err := exec.Command(
-		"git",
-		"-C",
-		path,
-		"rev-parse",
-		"--show-toplevel",
-	).Output()
+	repo, err := loadOptions(flags.Path, command.Config, command.Profile)
 	if err != nil {
-		if e, ok := err.(*exec.ExitError); ok {
-			if e.ExitCode() == 128 {
-				return nil, nil
-			}
-		}
-		return nil, fmt.Errorf("run cmd: %w", err)
+		fatal(err)
 	}
 
-	if err := os.Chdir(strings.TrimSpace(string(stdout))); err != nil {
-		return nil, fmt.Errorf("chdir: %w", err)
+	if command.Theme != "" {
+		applyTheme(&flags, themes[command.Theme])
 	}
 
-	state := &State{State: ""}
-	switch {
-	case pathExists(".git/rebase-merge"):
-		step, err := readInt(".git/rebase-merge/msgnum")
-		if err != nil {
-			return nil, fmt.Errorf("read rebase-merge/msgnum: %w", err)
-		}
-		state.Step = step
+	if command.SymbolSet != "" {
+		applySymbolSet(&flags.Symbols, symbolSets[command.SymbolSet])
+	}
 
-		total, err := readInt(".git/rebase-merge/end")
+	if command.SymbolsFile != "" {
+		set, err := readSymbols(command.SymbolsFile)
 		if err != nil {
-			return nil, fmt.Errorf("read rebase-merge/end: %w", err)
+			fatal(err)
 		}
-		state.Total = total
+		applySymbolSet(&flags.Symbols, set)
+	}
 
-		if pathExists(".git/rebase-merge/interactive") {
-			state.State = RebaseInteractive
-		} else {
-			state.State = RebaseMerge
-		}
-	case pathExists(".git/rebase-apply"):
-		step, err := readInt(".git/rebase-apply/next")
-		if err != nil {
-			return nil, fmt.Errorf("read rebase-apply/next: %w", err)
+	if command.ASCIISafe {
+		if replaced := asciiSafe(&flags.Symbols); len(replaced) > 0 {
+			fmt.Fprintf(os.Stderr, "replaced non-ASCII symbols: %s\n", strings.Join(replaced, ", "))
 		}
-		state.Step = step
+	}
 
-		total, err := readInt(".git/rebase-apply/last")
-		if err != nil {
-			return nil, fmt.Errorf("read rebase-apply/last: %w", err)
+	if flags.Color == gitstatus.ColorAuto {
+		// Only color output going straight to a terminal, or to tmux which
+		// interprets its own style directives
+		flags.Color = gitstatus.ColorNever
+		if isTerminal(out) || flags.Output == gitstatus.OutputTmux {
+			flags.Color = gitstatus.ColorAlways
 		}
-		state.Total = total
-
-		switch {
-		case pathExists(".git/rebase-apply/rebasing"):
-			state.State = RebaseApply
-		case pathExists(".git/rebase-apply/applying"):
-			state.State = Am
-		default:
-			state.State = AmRebase
+	}
+
+	if flags.Path != repo.Path {
+		// The configuration selected another repository
+		if repo, err = gitstatus.LookupRepo(flags.Path, ""); err != nil {
+			fatal(err)
 		}
-	case pathExists(".git/MERGE_HEAD"):
-		state.State = Merging
-	case pathExists(".git/CHERRY_PICK_HEAD"):
-		state.State = CherryPick
-	case pathExists(".git/REVERT_HEAD"):
-		state.State = Reverting
-	case pathExists(".git/BISECT_LOG"):
-		state.State = Bisecting
 	}
 
-	return state, nil
+	output, status, err := gitstatus.RenderRepo(repo, flags)
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Fprint(out, output)
+
+	if command.FailOnConflict && status != nil && status.Conflict > 0 {
+		os.Exit(exitConflict)
+	}
 }
 
-// pathExists checks if a file or directory exists.
-func pathExists(path string) bool {
-	_, err := os.Stat(path)
-	return !errors.Is(err, os.ErrNotExist)
+// fatal logs err and exits with a code identifying its class.
+func fatal(err error) {
+	log.Print(err)
+	os.Exit(exitCode(err))
 }
 
-// readInt reads an integer from a file.
-func readInt(path string) (int, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return 0, fmt.Errorf("read file: %w", err)
+// exitCode returns the exit code identifying the class of err.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	var execErr *exec.Error
+	switch {
+	case errors.Is(err, gitstatus.ErrParse):
+		return exitParse
+	case errors.As(err, &exitErr), errors.As(err, &execErr):
+		return exitGit
+	default:
+		return exitError
 	}
+}
 
-	i, err := strconv.Atoi(strings.TrimSpace(string(b)))
-	if err != nil {
-		return 0, fmt.Errorf("parse int: %w", err)
+// openFD returns a file for the given open file descriptor.
+func openFD(fd int) (*os.File, error) {
+	if fd < 0 {
+		return nil, fmt.Errorf("invalid fd %d", fd)
 	}
 
-	return i, nil
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	if _, err := f.Stat(); err != nil {
+		return nil, fmt.Errorf("fd %d is not open: %w", fd, err)
+	}
+
+	return f, nil
 }
 
-// gitStatus retrieves the Git repository status.
-func gitStatus(path string) (string, error) {
-	stdout, err := exec.Command(
-		"git",
-		"-C",
-		path,
-		"status",
-		"--porcelain=2",
-		"--branch",
-		"--show-stash",
-	).Output()
-	if err != nil {
-		return "", fmt.Errorf("run cmd: %w", err)
+// asciiSafe replaces symbols containing non-ASCII characters with their ASCII
+// fallbacks and returns the names of the replaced symbols.
+func asciiSafe(symbols *gitstatus.Symbols) []string {
+	var replaced []string
+
+	v := reflect.ValueOf(symbols).Elem()
+	fallbacks := reflect.ValueOf(asciiSymbols)
+	for i := range v.NumField() {
+		symbol := v.Field(i).String()
+		if strings.IndexFunc(symbol, func(r rune) bool { return r > unicode.MaxASCII }) >= 0 {
+			v.Field(i).SetString(fallbacks.Field(i).String())
+			replaced = append(replaced, v.Type().Field(i).Name)
+		}
 	}
 
-	return string(stdout), nil
+	return replaced
 }
 
-// parseStatus parses the Git repository status output.
-func parseStatus(output string) (*Status, error) {
-	status := &Status{}
-
-	for _, line := range strings.Split(output, "\n") {
-		s := strings.Split(line, " ")
-		switch s[0] {
-		case "#":
-			switch s[1] {
-			case "branch.oid":
-				status.Commit = s[2]
-			case "branch.head":
-				status.Branch = s[2]
-			case "stash":
-				numStashed, err := strconv.Atoi(s[2])
-				if err != nil {
-					return nil, fmt.Errorf("parse num stashed: %w", err)
-				}
-				status.Stashed = numStashed
-			case "branch.upstream":
-				status.Upstream = s[2]
-			case "branch.ab":
-				ahead, err := strconv.Atoi(s[2][1:])
-				if err != nil {
-					return nil, fmt.Errorf("parse ahead: %w", err)
-				}
-				status.Ahead = ahead
-
-				behind, err := strconv.Atoi(s[3][1:])
-				if err != nil {
-					return nil, fmt.Errorf("parse behind: %w", err)
-				}
-				status.Behind = behind
-			}
-		case "1", "2":
-			if slices.Contains([]string{"DD", "AU", "UD", "UA", "DU", "AA", "UU"}, s[1]) {
-				status.Conflict++
-			} else if s[1][1] == 'M' {
-				status.Modified++
-			} else {
-				status.Staged++
-			}
-		case "?":
-			status.Untracked++
+// applySymbolSet replaces the symbols that were not set on the command line
+// with those defined by set.
+func applySymbolSet(symbols *gitstatus.Symbols, set gitstatus.Symbols) {
+	// Flags are identified by the symbol they point to
+	explicit := make(map[uintptr]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[reflect.ValueOf(f.Value).Pointer()] = true
+	})
+
+	v := reflect.ValueOf(symbols).Elem()
+	s := reflect.ValueOf(set)
+	for i := range v.NumField() {
+		if symbol := s.Field(i).String(); symbol != "" && !explicit[v.Field(i).Addr().Pointer()] {
+			v.Field(i).SetString(symbol)
 		}
 	}
-
-	return status, nil
 }
 
-// buildOutput builds the final output string based on the Git repository status.
-func buildOutput(status Status, state State, symbols Symbols, showUpstream bool) string {
-	var b strings.Builder
-	b.WriteString(symbols.Prefix)
+// readSymbols reads a symbol set from a JSON object or TOML file at path,
+// keyed by symbol name, e.g. "modified" or "staged-deleted".
+func readSymbols(path string) (gitstatus.Symbols, error) {
+	var symbols gitstatus.Symbols
 
-	if status.Branch == "(detached)" {
-		b.WriteString(fmt.Sprintf(":%s", status.Commit[:7]))
+	var set map[string]string
+	if filepath.Ext(path) == ".toml" {
+		config, err := readConfig(path)
+		if err != nil {
+			return symbols, err
+		}
+		set = config[""]
 	} else {
-		b.WriteString(status.Branch)
-
-		if status.Upstream == "" {
-			b.WriteString(fmt.Sprintf(" %s", symbols.Local))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return symbols, fmt.Errorf("read symbols: %w", err)
 		}
-		if status.Upstream != "" && showUpstream {
-			b.WriteString(fmt.Sprintf(" {%s}", status.Upstream))
+		if err := json.Unmarshal(data, &set); err != nil {
+			return symbols, fmt.Errorf("parse symbols %s: %w", path, err)
 		}
+	}
 
-		if status.Ahead > 0 || status.Behind > 0 {
-			b.WriteString(" ")
-
-			if status.Ahead > 0 {
-				b.WriteString(fmt.Sprintf("%s%d", symbols.Ahead, status.Ahead))
-			}
-
-			if status.Behind > 0 {
-				b.WriteString(fmt.Sprintf("%s%d", symbols.Behind, status.Behind))
-			}
+	v := reflect.ValueOf(&symbols).Elem()
+	for name, symbol := range set {
+		field := v.FieldByNameFunc(func(field string) bool {
+			return strings.EqualFold(field, strings.NewReplacer("-", "", "_", "").Replace(name))
+		})
+		if !field.IsValid() {
+			return symbols, fmt.Errorf("symbols %s: unknown symbol %q", path, name)
 		}
+		field.SetString(symbol)
 	}
 
-	b.WriteString(symbols.Sep)
+	return symbols, nil
+}
 
-	if state.State != "" {
-		b.WriteString(state.State)
+// colorValue is a flag.Value for a color, which is validated when set.
+type colorValue string
 
-		if state.Total > 0 {
-			b.WriteString(fmt.Sprintf(" %d/%d", state.Step, state.Total))
-		}
+// String returns the color.
+func (c *colorValue) String() string {
+	return string(*c)
+}
 
-		b.WriteString(symbols.Sep)
+// Set validates and sets the color.
+func (c *colorValue) Set(s string) error {
+	if _, err := gitstatus.ANSIColor(s); err != nil {
+		return err
 	}
 
-	if status.Staged > 0 {
-		b.WriteString(fmt.Sprintf("%s%d", symbols.Staged, status.Staged))
-	}
-	if status.Conflict > 0 {
-		b.WriteString(fmt.Sprintf("%s%d", symbols.Conflict, status.Conflict))
-	}
-	if status.Modified > 0 {
-		b.WriteString(fmt.Sprintf("%s%d", symbols.Modified, status.Modified))
-	}
-	if status.Untracked > 0 {
-		b.WriteString(fmt.Sprintf("%s%d", symbols.Untracked, status.Untracked))
-	}
-	if status.Stashed > 0 {
-		b.WriteString(fmt.Sprintf("%s%d", symbols.Stashed, status.Stashed))
+	*c = colorValue(s)
+	return nil
+}
+
+// enumValue is a flag.Value for a string that must be one of a set of
+// values, which is validated when set. An empty string can only be set if it
+// is one of them.
+type enumValue struct {
+	value  *string
+	values []string
+}
+
+// newEnumValue returns an enumValue setting p, which defaults to its current
+// value.
+func newEnumValue(p *string, values ...string) enumValue {
+	return enumValue{p, values}
+}
+
+// String returns the value.
+func (e enumValue) String() string {
+	if e.value == nil {
+		return ""
 	}
 
-	if status.Staged == 0 && status.Conflict == 0 && status.Modified == 0 && status.Untracked == 0 && status.Stashed == 0 {
-		b.WriteString(symbols.Clean)
+	return *e.value
+}
+
+// Set validates and sets the value.
+func (e enumValue) Set(s string) error {
+	if !slices.Contains(e.values, s) {
+		return fmt.Errorf("must be one of %s", strings.Join(slices.DeleteFunc(slices.Clone(e.values), func(v string) bool { return v == "" }), ", "))
 	}
 
-	b.WriteString(symbols.Suffix)
+	*e.value = s
+	return nil
+}
 
-	return b.String()
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
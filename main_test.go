@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/eric-carlsson/compact-git-status/gitstatus"
+)
+
+func TestMain(m *testing.M) {
+	// runMain runs the test binary in place of the command
+	if os.Getenv("COMPACT_GIT_STATUS_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// runMain runs the command with args, returning its stdout and exit code.
+func runMain(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+
+	home := t.TempDir()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(),
+		"COMPACT_GIT_STATUS_TEST_MAIN=1",
+		"HOME="+home,
+		"XDG_CONFIG_HOME="+home,
+		"GIT_CONFIG_GLOBAL="+os.DevNull,
+		"GIT_CONFIG_NOSYSTEM=1",
+	)
+
+	stdout, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(stdout), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(stdout), 0
+}
+
+// runTestGit runs git in dir, failing the test on errors.
+func runTestGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+
+	args = append([]string{"-C", dir}, args...)
+	if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+}
+
+// testRepo creates a repository with a single commit and its own committer
+// identity.
+func testRepo(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	dir := t.TempDir()
+	runTestGit(t, dir, "init", "-q", "-b", "main")
+	runTestGit(t, dir, "config", "user.name", "Test")
+	runTestGit(t, dir, "config", "user.email", "test@example.com")
+	runTestGit(t, dir, "commit", "-q", "--allow-empty", "-m", "initial")
+
+	return dir
+}
+
+func TestExitCode(t *testing.T) {
+	gitErr := exec.Command("git", "-C", t.TempDir(), "status").Run()
+	notFoundErr := exec.Command("compact-git-status-missing-command").Run()
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"parse", fmt.Errorf("%w: malformed line %q", gitstatus.ErrParse, "1 M"), exitParse},
+		{"git", fmt.Errorf("run cmd: %w", gitErr), exitGit},
+		{"git not found", fmt.Errorf("run cmd: %w", notFoundErr), exitGit},
+		{"other", errors.New("invalid theme"), exitError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenFD(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Like a descriptor a prompt framework opened for the process
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	out, err := openFD(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := out.WriteString("[main|ok]"); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "[main|ok]" {
+		t.Errorf("read %q from the pipe, want %q", got, "[main|ok]")
+	}
+
+	for _, fd := range []int{-1, 1 << 20} {
+		if _, err := openFD(fd); err == nil {
+			t.Errorf("openFD(%d) succeeded, want error", fd)
+		}
+	}
+}
+
+func TestASCIISafe(t *testing.T) {
+	symbols := gitstatus.Symbols{Prefix: "(", Ahead: "↑", Modified: "✚", Untracked: "…", Stashed: "stash"}
+
+	replaced := asciiSafe(&symbols)
+
+	want := gitstatus.Symbols{Prefix: "(", Ahead: "^", Modified: "+", Untracked: "?", Stashed: "stash"}
+	if symbols != want {
+		t.Errorf("asciiSafe() symbols = %+v, want %+v", symbols, want)
+	}
+	if wantReplaced := []string{"Ahead", "Modified", "Untracked"}; !reflect.DeepEqual(replaced, wantReplaced) {
+		t.Errorf("asciiSafe() = %v, want %v", replaced, wantReplaced)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	outside := t.TempDir()
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(outside))
+
+	tests := []struct {
+		name, path, want string
+		wantCode         int
+	}{
+		{"inside", testRepo(t), "true", 0},
+		{"outside", outside, "false", exitError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, code := runMain(t, "-probe", "-path", tt.path)
+			if got != tt.want || code != tt.wantCode {
+				t.Errorf("-probe printed %q and exited %d, want %q and %d", got, code, tt.want, tt.wantCode)
+			}
+		})
+	}
+
+	// Probing does not load the configuration
+	config := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(config, []byte("max-count = many\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, code := runMain(t, "-probe", "-config", config, "-path", testRepo(t)); got != "true" || code != 0 {
+		t.Errorf("-probe with an invalid configuration file printed %q and exited %d, want %q and 0", got, code, "true")
+	}
+}
+
+func TestFailOnConflict(t *testing.T) {
+	clean := testRepo(t)
+
+	conflicted := testRepo(t)
+	// commit commits file with content on the current branch
+	commit := func(content string) {
+		if err := os.WriteFile(filepath.Join(conflicted, "file"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		runTestGit(t, conflicted, "add", "file")
+		runTestGit(t, conflicted, "commit", "-q", "-m", content)
+	}
+	runTestGit(t, conflicted, "checkout", "-q", "-b", "topic")
+	commit("topic\n")
+	runTestGit(t, conflicted, "checkout", "-q", "main")
+	commit("main\n")
+	if err := exec.Command("git", "-C", conflicted, "merge", "-q", "topic").Run(); err == nil {
+		t.Fatal("merge succeeded, want conflict")
+	}
+
+	tests := []struct {
+		name, path     string
+		failOnConflict bool
+		wantCode       int
+	}{
+		{"clean", clean, true, 0},
+		{"conflicted", conflicted, true, exitConflict},
+		{"conflicted without flag", conflicted, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, code := runMain(t, "-path", tt.path, fmt.Sprintf("-fail-on-conflict=%t", tt.failOnConflict))
+			if code != tt.wantCode {
+				t.Errorf("exited %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name, config string
+		wantCode     int
+	}{
+		{"valid", "theme = \"nerd\"\nstate-position = \"end\"\n", 0},
+		{"invalid theme", "theme = \"bogus\"\n", exitError},
+		{"invalid state position", "state-position = \"start\"\n", exitError},
+		{"invalid color in profile", "[profile.work]\ncolor = \"sometimes\"\n", exitError},
+		{"unknown option", "bogus = true\n", exitError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, code := runMain(t, "config", "validate", path); code != tt.wantCode {
+				t.Errorf("config validate exited %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestOptionPrecedence(t *testing.T) {
+	dir := testRepo(t)
+	config := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(config, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each source sets max-count to its precedence, and is added in turn
+	tests := []struct {
+		name string
+		set  func()
+		want string
+	}{
+		{"configuration file", func() {
+			if err := os.WriteFile(config, []byte("max-count = 1\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}, "1"},
+		{"git config", func() { runTestGit(t, dir, "config", "compactstatus.max-count", "2") }, "2"},
+		{"repository file", func() {
+			if err := os.WriteFile(filepath.Join(dir, ".compact-git-status"), []byte("max-count = 3\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}, "3"},
+		{"environment", func() { t.Setenv("CGS_MAX_COUNT", "4") }, "4"},
+	}
+
+	got, _ := runMain(t, "-path", dir, "-config", config, "config", "get", "max-count")
+	if want := "0\n"; got != want {
+		t.Errorf("without options, config get printed %q, want %q", got, want)
+	}
+
+	for _, tt := range tests {
+		tt.set()
+		got, _ := runMain(t, "-path", dir, "-config", config, "config", "get", "max-count")
+		if want := tt.want + "\n"; got != want {
+			t.Errorf("with the %s, config get printed %q, want %q", tt.name, got, want)
+		}
+	}
+
+	got, _ = runMain(t, "-path", dir, "-config", config, "-max-count", "5", "config", "get", "max-count")
+	if want := "5\n"; got != want {
+		t.Errorf("with the command line, config get printed %q, want %q", got, want)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(config, []byte("max-count = 1\n[profile.work]\nmax-count = 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	selected := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(selected, []byte("profile = \"work\"\nmax-count = 1\n[profile.work]\nmax-count = 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		want     string
+		wantCode int
+	}{
+		{"no profile", []string{"-config", config}, "1\n", 0},
+		{"flag", []string{"-config", config, "-profile", "work"}, "2\n", 0},
+		{"environment", []string{"-config", config}, "2\n", 0},
+		{"option", []string{"-config", selected}, "2\n", 0},
+		{"unknown", []string{"-config", config, "-profile", "home"}, "", exitError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "environment" {
+				t.Setenv("CGS_PROFILE", "work")
+			}
+
+			got, code := runMain(t, append(tt.args, "-path", t.TempDir(), "config", "get", "max-count")...)
+			if got != tt.want || code != tt.wantCode {
+				t.Errorf("config get printed %q and exited %d, want %q and %d", got, code, tt.want, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestReadSymbols(t *testing.T) {
+	tests := []struct {
+		name, file, content string
+		want                gitstatus.Symbols
+		wantErr             bool
+	}{
+		{"json", "symbols.json", `{"modified": "M", "staged-deleted": "SD", "Local_Sep": "-"}`, gitstatus.Symbols{Modified: "M", StagedDeleted: "SD", LocalSep: "-"}, false},
+		{"toml", "symbols.toml", "modified = \"M\"\nstaged_deleted = \"SD\"\n", gitstatus.Symbols{Modified: "M", StagedDeleted: "SD"}, false},
+		{"unknown symbol", "symbols.json", `{"modifed": "M"}`, gitstatus.Symbols{}, true},
+		{"invalid json", "symbols.json", `{"modified": `, gitstatus.Symbols{}, true},
+		{"invalid toml", "symbols.toml", "modified = M\n", gitstatus.Symbols{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readSymbols(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readSymbols() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("readSymbols() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import "github.com/eric-carlsson/compact-git-status/gitstatus"
+
+// Theme bundles symbols and colors.
+type Theme struct {
+	Symbols gitstatus.Symbols
+	Colors  gitstatus.Colors
+}
+
+// themes are the built-in themes selectable with -theme.
+var themes = map[string]Theme{
+	"minimal": {
+		Symbols: gitstatus.Symbols{
+			Prefix:    "(",
+			Suffix:    ")",
+			Sep:       " ",
+			Ahead:     "↑",
+			Behind:    "↓",
+			Staged:    "+",
+			Conflict:  "!",
+			Modified:  "~",
+			Deleted:   "-",
+			Untracked: "?",
+			Stashed:   "*",
+			Clean:     "✓",
+		},
+		Colors: gitstatus.Colors{
+			State:    "bold",
+			Conflict: "red",
+		},
+	},
+	"classic": {
+		Colors: gitstatus.Colors{
+			Branch:    "magenta",
+			State:     "bold red",
+			Staged:    "red",
+			Conflict:  "red",
+			Modified:  "blue",
+			Untracked: "cyan",
+			Stashed:   "bold blue",
+			Clean:     "bold green",
+		},
+	},
+	"nerd": {
+		Symbols: symbolSets["nerd"],
+		Colors: gitstatus.Colors{
+			Branch:    "blue",
+			State:     "bold magenta",
+			Ahead:     "green",
+			Behind:    "red",
+			Staged:    "green",
+			Conflict:  "red",
+			Modified:  "yellow",
+			Untracked: "bright-black",
+			Stashed:   "cyan",
+			Clean:     "green",
+		},
+	},
+	"emoji": {
+		Symbols: gitstatus.Symbols{
+			Branch:    "🌿 ",
+			Ahead:     "⬆️",
+			Behind:    "⬇️",
+			Staged:    "✅",
+			Conflict:  "💥",
+			Modified:  "📝",
+			Untracked: "❓",
+			Stashed:   "📦",
+			Clean:     "✨",
+		},
+		Colors: gitstatus.Colors{
+			Branch: "bold",
+		},
+	},
+	"monochrome": {
+		Colors: gitstatus.Colors{
+			Branch:   "bold",
+			State:    "bold reverse",
+			Conflict: "bold reverse",
+			Clean:    "dim",
+		},
+	},
+}
+
+// applyTheme applies the theme's symbols and colors, except those set on the
+// command line.
+func applyTheme(flags *gitstatus.Flags, theme Theme) {
+	applySymbolSet(&flags.Symbols, theme.Symbols)
+
+	// Colors are unset by default, so any set color was set explicitly
+	colors := &flags.Colors
+	for _, c := range []struct {
+		color *string
+		theme string
+	}{
+		{&colors.Branch, theme.Colors.Branch},
+		{&colors.State, theme.Colors.State},
+		{&colors.Ahead, theme.Colors.Ahead},
+		{&colors.Behind, theme.Colors.Behind},
+		{&colors.Staged, theme.Colors.Staged},
+		{&colors.Conflict, theme.Colors.Conflict},
+		{&colors.Modified, theme.Colors.Modified},
+		{&colors.Untracked, theme.Colors.Untracked},
+		{&colors.Stashed, theme.Colors.Stashed},
+		{&colors.Clean, theme.Colors.Clean},
+	} {
+		if *c.color == "" {
+			*c.color = c.theme
+		}
+	}
+}